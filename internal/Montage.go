@@ -3,45 +3,111 @@ package internal
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
-	"image/jpeg"
-	"io/ioutil"
-	"os"
+	"math"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/disintegration/imaging"
 	libjpeg "github.com/pixiv/go-libjpeg/jpeg"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
 )
 
 // Montage for montage of an image out of multiple parts as defined by the MontageConfig
-// This holds the montage canvas in which images are written
+// This holds the montage canvas in which images are written.
+// Montage is safe for concurrent use. Drawing on the canvas is serialized with updateMutex and
+// exports encode a copy of the canvas so they never contain half-drawn images.
 type Montage struct {
-	Config      MontageConfig // Wallpaper configuration for this montage
+	Config      MontageConfig // Wallpaper configuration for this montage, guarded by the updateMutex
 	UpdateCount int           // Canvas update count since last ExportMontage
+	firstUpdate time.Time     // Time of the first canvas update since the last rebuild
+	lastUpdate  time.Time     // Time of the most recent canvas update
 	useLibJpeg  bool          // use the faster libjpeg instead of the image library to draw images on canvas.
 	isActive    bool          // Montage background update is active
 	//layout      []MontageImage  // Actual layout of images on canvas
-	canvas          *image.RGBA            // canvas to draw the montage on
-	resizing        imaging.ResampleFilter // default method used for resizing
-	actualPlacement []ImagePlacement       // Actual placement of the images in this montage
+	canvas          *image.RGBA                // canvas to draw the montage on
+	resizing        imaging.ResampleFilter     // default method used for resizing
+	actualPlacement []ImagePlacement           // Actual placement of the images in this montage
+	sourceImages    map[string][]byte          // latest image data of each source, used to redraw the canvas
+	sourceHashes    map[string][sha1.Size]byte // hash of the last drawn image of each source
+	sourceUpdated   map[string]time.Time       // time of the last successful update of each source
+	staleSources    map[string]bool            // sources whose placement currently shows the missing image
+	sourceSizes     map[string]image.Point     // image size of each source, used by the justified layout
+	missingImage    image.Image                // substitute for missing images, nil to generate a 'no signal' image
+	background      color.Color                // background color of the canvas and the remainder of image placements
+	updateMutex     sync.Mutex                 // mutex to serialize access to the canvas and update state
+	exportMutex     sync.Mutex                 // mutex to serialize use of the export buffer
+	changeMutex     sync.Mutex                 // mutex to serialize changes of the wallpaper configuration
+	exportCanvas    *image.RGBA                // copy of the canvas that is being exported
+	isReleased      bool                       // the montage is deleted and its canvas released
+	timings         BuildTimings               // time spent building the montage since the last export
+	sourceHealth    map[string]*SourceHealth   // health of each image source
+	healthChanges   []SourceHealthChange       // source transitions between healthy and stale not yet taken
+	generation      int                        // number of changes taken, see TakeChanges
+	changedSources  map[string]bool            // sources whose placements changed since the last TakeChanges
+	layoutChanged   bool                       // all placements changed since the last TakeChanges
+	layoutVersion   int                        // incremented when the canvas and placements are rebuilt
 }
 
+// BuildTimings holds the time spent in each step of building a montage
+type BuildTimings struct {
+	Decode time.Duration // time decoding source images
+	Resize time.Duration // time resizing source images
+	Draw   time.Duration // time drawing images onto the canvas
+	Encode time.Duration // time encoding the canvas
+}
+
+// Total returns the total time spent building the montage
+func (timings BuildTimings) Total() time.Duration {
+	return timings.Decode + timings.Resize + timings.Draw + timings.Encode
+}
+
+// errLayoutChanged is returned when drawing into a placement of a layout that has since been rebuilt
+var errLayoutChanged = errors.New("montage layout has changed")
+
+// ErrMontageReleased is returned when drawing or exporting a montage that has been released
+var ErrMontageReleased = errors.New("montage is released")
+
 // MontageConfig containing the definition of a wallpaper
 type MontageConfig struct {
-	ID                 string           `yaml:"ID"`                 // ID of the wallpaper
-	Border             int              `yaml:"border,omitempty"`   // border around image
-	Name               string           `yaml:"name"`               // montage name
-	Filename           string           `yaml:"filename,omitempty"` // file to save montage image as
-	Height             int              `yaml:"height,omitempty"`   // montage height
-	Width              int              `yaml:"width,omitempty"`    // montage width
-	WaitTime           int              `yaml:"waitTime,omitempty"` // Time to wait for updates and rebuild the montage. Default is 3 seconds
-	Publish            bool             `yaml:"publish"`            // publish the resulting image
-	Resize             MontageResize    `yaml:"resize,omitempty"`   // Image resize in this montage: 'crop', 'width' or 'height'. Default is height.
-	Rows               int              `yaml:"rows,omitempty"`     // Number of rows to organize images in.
-	MissingImage       string           `yaml:"noimage,omitempty"`  // substitute for missing images, default is to keep the last image
-	ProposedPlacements []ImagePlacement `yaml:"images"`             // Proposed placement of images to montage
+	ID                 string             `yaml:"ID"`                      // ID of the wallpaper
+	Border             int                `yaml:"border,omitempty"`        // border around image
+	Name               string             `yaml:"name"`                    // montage name
+	Filename           string             `yaml:"filename,omitempty"`      // file to save montage image as
+	FileMode           string             `yaml:"fileMode,omitempty"`      // Octal permissions of the image files, for example '0640'. Default is 0644
+	HistoryFolder      string             `yaml:"historyFolder,omitempty"` // folder to keep timestamped copies of the montage image in. Default is no history
+	HistoryCount       int                `yaml:"historyCount,omitempty"`  // Max number of history images to keep. Default 0 keeps all
+	HistoryMaxAge      int                `yaml:"historyMaxAge,omitempty"` // Max age in seconds of history images to keep. Default 0 keeps all
+	LatestLink         string             `yaml:"latestLink,omitempty"`    // symbolic link to update to the newest image file
+	Height             int                `yaml:"height,omitempty"`        // montage height
+	Width              int                `yaml:"width,omitempty"`         // montage width
+	WaitTime           int                `yaml:"waitTime,omitempty"`      // Time to wait for updates and rebuild the montage. Default is 3 seconds
+	MaxWaitTime        int                `yaml:"maxWaitTime,omitempty"`   // Max time a rebuild is delayed by continuous updates. Default is 3x WaitTime
+	Publish            bool               `yaml:"publish"`                 // publish the resulting image
+	Resize             MontageResize      `yaml:"resize,omitempty"`        // Image resize in this montage: 'crop', 'fit', 'width' or 'height'. Default is height.
+	Align              MontageAlign       `yaml:"align,omitempty"`         // Alignment of images within their placement. Default is center
+	Background         string             `yaml:"background,omitempty"`    // Background color as #rrggbb. Default is black
+	Rows               int                `yaml:"rows,omitempty"`          // Number of rows to organize images in.
+	RowWeights         []float64          `yaml:"rowWeights,omitempty"`    // Optional relative height of each grid row. Default is 1
+	ColWeights         []float64          `yaml:"colWeights,omitempty"`    // Optional relative width of each grid column. Default is 1
+	Layout             MontageLayout      `yaml:"layout,omitempty"`        // Layout of the images: 'grid', 'free', 'justified', '1+5', '1+7', '2+8' or 'side-strip'. Default is grid
+	MissingImage       string             `yaml:"noimage,omitempty"`       // substitute image file for missing images, default is a generated 'no signal' image
+	MaxAge             int                `yaml:"maxAge,omitempty"`        // Max age in seconds of a source image before it is replaced by the missing image. Default 0 keeps the last image
+	Format             MontageFormat      `yaml:"format,omitempty"`        // Image format: 'jpeg', 'png', 'bmp' or 'tiff'. Default is jpeg
+	Quality            int                `yaml:"quality,omitempty"`       // JPEG quality 1-100. Default is 80
+	Progressive        bool               `yaml:"progressive,omitempty"`   // Encode progressive JPEG. This uses libjpeg
+	Optimize           bool               `yaml:"optimize,omitempty"`      // Optimize the JPEG huffman tables. This uses libjpeg
+	Renditions         []MontageRendition `yaml:"renditions,omitempty"`    // Additional sizes and formats of the montage image
+	ProposedPlacements []ImagePlacement   `yaml:"images"`                  // Proposed placement of images to montage
 }
 
 // ImagePlacement describes the placement of an image on the canvas
@@ -49,32 +115,112 @@ type MontageConfig struct {
 type ImagePlacement struct {
 	//Order  int           // Optional order in which to sort the images.
 	Source   string        `yaml:"source"`             // Image source. Topic, file://filename, or http://url
-	X        int           `yaml:"x,omitempty"`        // Optional x-offset to use instead of automatic layout. 0 is automatic
-	Y        int           `yaml:"y,omitempty"`        // Optional y-offset to use instead of automatic layout. 0 is automatic
+	X        int           `yaml:"x,omitempty"`        // Optional x-offset in the grid cell, clipped to the cell. Absolute position in free layout
+	Y        int           `yaml:"y,omitempty"`        // Optional y-offset in the grid cell, clipped to the cell. Absolute position in free layout
 	Width    int           `yaml:"width,omitempty"`    // Optional width to use instead of automatic calculated. 0 is automatic
-	Height   int           `yaml:"height,omitempty"`   // Optional height to use instead of automatic calculated. 0 is automatic
+	Height   int           `yaml:"height,omitempty"`   // Optional height in free layout. 0 extends to the bottom of the canvas
+	Unit     string        `yaml:"unit,omitempty"`     // Unit of position and size in free layout: 'px' or '%' of the canvas. Default is px
 	Interval int           `yaml:"interval,omitempty"` // Interval to poll source, in case of IP camera, default is 900 seconds
 	Resize   MontageResize `yaml:"resize,omitempty"`   // Optional resize to use instead of the montage setting
+	Align    MontageAlign  `yaml:"align,omitempty"`    // Optional alignment to use instead of the montage setting
+	Primary  bool          `yaml:"primary,omitempty"`  // Show the image in the primary slot of a layout template
+	RowSpan  int           `yaml:"rowSpan,omitempty"`  // Optional number of grid rows covered by the image. Default is 1
+	ColSpan  int           `yaml:"colSpan,omitempty"`  // Optional number of grid columns covered by the image. Default is 1
 }
 
+// DefaultWaitTime is the default time in seconds to wait for updates before rebuilding a montage
+const DefaultWaitTime = 3
+
 // MontageResize method of resizing
 type MontageResize string
 
 // Available resize methods for montage images
 const (
 	MontageResizeCrop   MontageResize = "crop"
+	MontageResizeFit    MontageResize = "fit"
 	MontageResizeHeight MontageResize = "height"
 	MontageResizeNone   MontageResize = "none"
 	MontageResizeScale  MontageResize = "scale"
 	MontageResizeWidth  MontageResize = "width"
 )
 
+// MontageAlign anchor of an image within its placement
+type MontageAlign string
+
+// Available alignments of montage images
+const (
+	MontageAlignBottom      MontageAlign = "bottom"
+	MontageAlignBottomLeft  MontageAlign = "bottom-left"
+	MontageAlignBottomRight MontageAlign = "bottom-right"
+	MontageAlignCenter      MontageAlign = "center"
+	MontageAlignLeft        MontageAlign = "left"
+	MontageAlignRight       MontageAlign = "right"
+	MontageAlignTop         MontageAlign = "top"
+	MontageAlignTopLeft     MontageAlign = "top-left"
+	MontageAlignTopRight    MontageAlign = "top-right"
+)
+
+// alignOffset returns the offset of an image of the given size within the placement
+// Images larger than the placement get a negative offset and are clipped.
+func alignOffset(align MontageAlign, placementSize image.Point, imageSize image.Point) image.Point {
+	offset := placementSize.Sub(imageSize).Div(2)
+	if strings.Contains(string(align), "left") {
+		offset.X = 0
+	} else if strings.Contains(string(align), "right") {
+		offset.X = placementSize.X - imageSize.X
+	}
+	if strings.HasPrefix(string(align), "top") {
+		offset.Y = 0
+	} else if strings.HasPrefix(string(align), "bottom") {
+		offset.Y = placementSize.Y - imageSize.Y
+	}
+	return offset
+}
+
+// fitImage scales the image to fit within the given size while preserving its aspect ratio
+func fitImage(img image.Image, width int, height int, filter imaging.ResampleFilter) image.Image {
+	imgSize := img.Bounds().Size()
+	if imgSize.X <= 0 || imgSize.Y <= 0 || width <= 0 || height <= 0 {
+		return img
+	}
+	scale := math.Min(float64(width)/float64(imgSize.X), float64(height)/float64(imgSize.Y))
+	fitWidth := int(math.Max(1, math.Round(float64(imgSize.X)*scale)))
+	fitHeight := int(math.Max(1, math.Round(float64(imgSize.Y)*scale)))
+	return imaging.Resize(img, fitWidth, fitHeight, filter)
+}
+
+// parseColor parses a color in the #rrggbb format
+// An empty string is black.
+func parseColor(hexColor string) (color.RGBA, error) {
+	rgba := color.RGBA{A: 255}
+	if hexColor == "" {
+		return rgba, nil
+	}
+	_, err := fmt.Sscanf(hexColor, "#%02x%02x%02x", &rgba.R, &rgba.G, &rgba.B)
+	if err != nil || len(hexColor) != 7 {
+		return rgba, fmt.Errorf("invalid color '%s', expected #rrggbb", hexColor)
+	}
+	return rgba, nil
+}
+
+// loadBackground returns the background color of the montage configuration
+// Invalid colors are logged and replaced with black.
+func loadBackground(config *MontageConfig) color.Color {
+	background, err := parseColor(config.Background)
+	if err != nil {
+		logrus.Errorf("loadBackground: Montage %s: %s", config.Name, err)
+	}
+	return background
+}
+
 /*
 * Draw the image from the layout onto the canvas at the layout position and increase UpdateCount
-* This uses a 'not-found' image if the the image is not found
+* The image is aligned within the layout and clipped to it. The remainder is filled with the background.
+* The image is not drawn if the layout was rebuilt since layoutVersion, as its placement no longer applies.
  */
-func (montage *Montage) drawImage(img image.Image, imageLayout *ImagePlacement) error {
+func (montage *Montage) drawImage(img image.Image, imageLayout *ImagePlacement, layoutVersion int) error {
 	// resize to fit the available space
+	startTime := time.Now()
 	resizedImg := img
 	switch imageLayout.Resize {
 	case MontageResizeWidth:
@@ -83,6 +229,8 @@ func (montage *Montage) drawImage(img image.Image, imageLayout *ImagePlacement)
 		resizedImg = imaging.Resize(img, 0, imageLayout.Height, montage.resizing)
 	case MontageResizeCrop:
 		resizedImg = imaging.Thumbnail(img, imageLayout.Width, imageLayout.Height, montage.resizing)
+	case MontageResizeFit:
+		resizedImg = fitImage(img, imageLayout.Width, imageLayout.Height, montage.resizing)
 	case MontageResizeScale:
 		resizedImg = imaging.Resize(img, imageLayout.Width, imageLayout.Height, montage.resizing)
 	case MontageResizeNone:
@@ -91,50 +239,183 @@ func (montage *Montage) drawImage(img image.Image, imageLayout *ImagePlacement)
 		resizedImg = img
 	}
 
-	// Embed the image centered in its place into the main montage image
-	// imageSize := resizedImg.Bounds()
-	// xOffset := (imageLayout.Width - imageSize.Max.X) / 2
-	// if xOffset < 0 {
-	// 	xOffset = 0
-	// }
-	// yOffset := (imageLayout.Height - imageSize.Max.Y) / 2
-	// if yOffset < 0 {
-	// 	yOffset = 0
-	// }
-	// rectangle := image.Rect(imageLayout.X+xOffset, imageLayout.Y+yOffset,
-	// 	imageLayout.X+imageLayout.Width, imageLayout.Y+imageLayout.Height)
+	// Embed the image aligned in its place into the main montage image
 	rectangle := image.Rect(imageLayout.X, imageLayout.Y,
 		imageLayout.X+imageLayout.Width, imageLayout.Y+imageLayout.Height)
-	draw.Draw(montage.canvas, rectangle, resizedImg, image.ZP, draw.Src)
+	imageBounds := resizedImg.Bounds()
+	offset := alignOffset(imageLayout.Align, rectangle.Size(), imageBounds.Size())
+	imageRect := imageBounds.Sub(imageBounds.Min).Add(rectangle.Min.Add(offset))
+	clippedRect := imageRect.Intersect(rectangle)
+	sourcePoint := imageBounds.Min.Add(clippedRect.Min.Sub(imageRect.Min))
+	resizeTime := time.Since(startTime)
 
-	montage.UpdateCount++
+	montage.updateMutex.Lock()
+	defer montage.updateMutex.Unlock()
+	if montage.isReleased {
+		return ErrMontageReleased
+	}
+	if layoutVersion != montage.layoutVersion {
+		return errLayoutChanged
+	}
+	startTime = time.Now()
+	if clippedRect != rectangle {
+		draw.Draw(montage.canvas, rectangle, &image.Uniform{C: montage.background}, image.ZP, draw.Src)
+	}
+	draw.Draw(montage.canvas, clippedRect, resizedImg, sourcePoint, draw.Src)
+	montage.timings.Resize += resizeTime
+	montage.timings.Draw += time.Since(startTime)
+
+	montage.markUpdated()
 	return nil
 }
 
+// markUpdated increases the UpdateCount and tracks the update time for scheduling a rebuild
+// The caller must hold the updateMutex.
+func (montage *Montage) markUpdated() {
+	now := time.Now()
+	if montage.UpdateCount == 0 {
+		montage.firstUpdate = now
+	}
+	montage.lastUpdate = now
+	montage.UpdateCount++
+}
+
+// IsRebuildDue returns true when the montage has updates and a rebuild is due.
+// Updates are coalesced until no new updates have arrived for WaitTime seconds. To avoid
+// starvation by busy sources a rebuild is forced when the first pending update is older
+// than MaxWaitTime seconds.
+func (montage *Montage) IsRebuildDue(now time.Time) bool {
+	montage.updateMutex.Lock()
+	defer montage.updateMutex.Unlock()
+	if montage.UpdateCount == 0 {
+		return false
+	}
+	waitTime := montage.Config.WaitTime
+	if waitTime <= 0 {
+		waitTime = DefaultWaitTime
+	}
+	maxWaitTime := montage.Config.MaxWaitTime
+	if maxWaitTime <= 0 {
+		maxWaitTime = 3 * waitTime
+	}
+	if now.Sub(montage.lastUpdate) >= time.Duration(waitTime)*time.Second {
+		return true
+	}
+	return now.Sub(montage.firstUpdate) >= time.Duration(maxWaitTime)*time.Second
+}
+
+// addDecodeTime adds the time spent decoding a source image to the build timings
+func (montage *Montage) addDecodeTime(decodeTime time.Duration) {
+	montage.updateMutex.Lock()
+	defer montage.updateMutex.Unlock()
+	montage.timings.Decode += decodeTime
+}
+
+// TakeBuildTimings returns the time spent building the montage since the last call and resets it
+func (montage *Montage) TakeBuildTimings() BuildTimings {
+	montage.updateMutex.Lock()
+	defer montage.updateMutex.Unlock()
+	timings := montage.timings
+	montage.timings = BuildTimings{}
+	return timings
+}
+
+// TakeChanges returns the next generation number of the montage and the index of the image
+// placements that changed since the previous generation.
+func (montage *Montage) TakeChanges() (generation int, changedPlacements []int) {
+	montage.updateMutex.Lock()
+	defer montage.updateMutex.Unlock()
+	montage.generation++
+	changedPlacements = make([]int, 0)
+	for index, placement := range montage.Config.ProposedPlacements {
+		if montage.layoutChanged || montage.changedSources[placement.Source] {
+			changedPlacements = append(changedPlacements, index)
+		}
+	}
+	montage.layoutChanged = false
+	montage.changedSources = make(map[string]bool)
+	return montage.generation, changedPlacements
+}
+
+// RestoreChanges undoes TakeChanges when no new image was generated from the changes.
+// The placements are included in the changes of the next generation.
+func (montage *Montage) RestoreChanges(changedPlacements []int) {
+	montage.updateMutex.Lock()
+	defer montage.updateMutex.Unlock()
+	montage.generation--
+	for _, index := range changedPlacements {
+		if index < len(montage.Config.ProposedPlacements) {
+			montage.changedSources[montage.Config.ProposedPlacements[index].Source] = true
+		}
+	}
+}
+
+// getLayoutVersion returns the version of the current canvas and placements
+func (montage *Montage) getLayoutVersion() int {
+	montage.updateMutex.Lock()
+	defer montage.updateMutex.Unlock()
+	return montage.layoutVersion
+}
+
+// getConfig returns a copy of the current montage configuration
+// Use this instead of the Config field outside the updateMutex.
+func (montage *Montage) getConfig() MontageConfig {
+	montage.updateMutex.Lock()
+	defer montage.updateMutex.Unlock()
+	return montage.Config
+}
+
+// ResetUpdateCount clears the pending updates after the montage is rebuilt
+func (montage *Montage) ResetUpdateCount() {
+	montage.updateMutex.Lock()
+	defer montage.updateMutex.Unlock()
+	montage.UpdateCount = 0
+}
+
 // DrawImageIntoLayout draws the image on canvas and increase the UpdateCount
 // This uses the image library which is a bit slow.
 func (montage *Montage) DrawImageIntoLayout(layout *ImagePlacement, imageData []byte) error {
+	img, err := montage.decodeImage(layout, imageData)
+	if err != nil {
+		return err
+	}
+	return montage.drawImage(img, layout, montage.getLayoutVersion())
+}
+
+// decodeImage decodes the image data of the layout using the image library
+func (montage *Montage) decodeImage(layout *ImagePlacement, imageData []byte) (image.Image, error) {
 	// var m runtime.MemStats
 	// runtime.ReadMemStats(&m)
 	// logger.Info("drawImageOfTopic entry Memory: ", m.Alloc)
 
 	buffer := bytes.NewBuffer(imageData)
 	// Decode takes 85% of all cpu: https://github.com/golang/go/issues/24499
+	startTime := time.Now()
 	img, imageType, err := image.Decode(buffer)
+	montage.addDecodeTime(time.Since(startTime))
 
 	if err != nil {
-		logrus.Errorf("montage.DrawImageIntoLayout: Failed decoding image '%s' for montage '%s': %s",
-			layout.Source, montage.Config.Name, err)
-		return err
+		logrus.Errorf("montage.decodeImage: Failed decoding image '%s' for montage '%s': %s",
+			layout.Source, montage.getConfig().Name, err)
+		montage.recordSourceError(layout.Source, err, true)
+		return nil, err
 	}
-	logrus.Debugf("montage.DrawImageIntoLayout: Image of layout %s of type %s decoded", layout.Source, imageType)
-	err = montage.drawImage(img, layout)
-	return err
+	logrus.Debugf("montage.decodeImage: Image of layout %s of type %s decoded", layout.Source, imageType)
+	return img, nil
 }
 
 // DrawJpegIntoLayout draws the image on canvas and increase the UpdateCount
 // This uses libjpeg, which is faster than the native image library
 func (montage *Montage) DrawJpegIntoLayout(layout *ImagePlacement, imageData []byte) error {
+	img, err := montage.decodeJpeg(layout, imageData)
+	if err != nil {
+		return err
+	}
+	return montage.drawImage(img, layout, montage.getLayoutVersion())
+}
+
+// decodeJpeg decodes the jpeg image data of the layout using libjpeg
+func (montage *Montage) decodeJpeg(layout *ImagePlacement, imageData []byte) (image.Image, error) {
 	// var m runtime.MemStats
 	// runtime.ReadMemStats(&m)
 	// logger.Info("drawImageOfTopic entry Memory: ", m.Alloc)
@@ -142,138 +423,443 @@ func (montage *Montage) DrawJpegIntoLayout(layout *ImagePlacement, imageData []b
 	buffer := bytes.NewBuffer(imageData)
 	var err error
 	opts := &libjpeg.DecoderOptions{}
+	startTime := time.Now()
 	img, err := libjpeg.Decode(buffer, opts)
+	montage.addDecodeTime(time.Since(startTime))
 	//img, err := prism.Decode(buffer)
 	if err != nil {
-		logrus.Errorf("montage.DrawJpegIntoLayout: Failed decoding jpeg image for montage %s: %s",
-			montage.Config.Name, err)
-		return err
+		logrus.Errorf("montage.decodeJpeg: Failed decoding jpeg image for montage %s: %s",
+			montage.getConfig().Name, err)
+		montage.recordSourceError(layout.Source, err, true)
+		return nil, err
 	}
-	logrus.Debugf("montage.DrawJpegIntoLayout: Jpeg Image of layout %s decoded", layout.Source)
-	err = montage.drawImage(img, layout)
-	return err
+	logrus.Debugf("montage.decodeJpeg: Jpeg Image of layout %s decoded", layout.Source)
+	return img, nil
 }
 
-// ExportMontageAsJPEG retrieves the montage as JPEG image
+// ExportMontage retrieves the montage as image in the configured format
+func (montage *Montage) ExportMontage() ([]byte, error) {
+	imageData, _, err := montage.exportMontage(false, false)
+	return imageData, err
+}
+
+// ExportMontageAsJPEG retrieves the montage as JPEG image, regardless of the configured format
 func (montage *Montage) ExportMontageAsJPEG() ([]byte, error) {
-	logrus.Debugf("montage.ExportMontage %s", montage.Config.Name)
-	// export image as JPEG
-	buf := new(bytes.Buffer)
-	var err error
-	if montage.useLibJpeg {
-		opt := libjpeg.EncoderOptions{}
-		opt.Quality = 80
-		err = libjpeg.Encode(buf, montage.canvas, &opt)
-	} else {
-		var opt jpeg.Options
-		opt.Quality = 80
-		err = jpeg.Encode(buf, montage.canvas, &opt)
+	imageData, _, err := montage.exportMontage(true, false)
+	return imageData, err
+}
+
+// ExportMontageWithRenditions retrieves the montage as image in the configured format and the
+// image of each configured rendition, in the order of the renditions.
+func (montage *Montage) ExportMontageWithRenditions() ([]byte, [][]byte, error) {
+	return montage.exportMontage(false, true)
+}
+
+// exportMontage encodes the montage in the configured format or as JPEG, and optionally its renditions
+// The canvas is copied before encoding so updates can continue while the image is encoded.
+func (montage *Montage) exportMontage(asJPEG bool, withRenditions bool) ([]byte, [][]byte, error) {
+	config := montage.getConfig()
+	logrus.Debugf("montage.ExportMontage %s", config.Name)
+	montage.exportMutex.Lock()
+	defer montage.exportMutex.Unlock()
+	canvas := montage.copyCanvas()
+	if canvas == nil {
+		return nil, nil, ErrMontageReleased
+	}
+	if asJPEG {
+		config.Format = MontageFormatJPEG
+	}
+
+	startTime := time.Now()
+	imageData, err := encodeImage(canvas, &config, montage.useLibJpeg)
+	renditionData := make([][]byte, 0)
+	for index := 0; withRenditions && err == nil && index < len(config.Renditions); index++ {
+		rendition := &config.Renditions[index]
+		var data []byte
+		data, err = encodeImage(renditionImage(canvas, rendition, montage.resizing),
+			renditionConfig(&config, rendition), montage.useLibJpeg)
+		renditionData = append(renditionData, data)
 	}
 	if err != nil {
-		logrus.Errorf("montage.ExportMontage Error encoding canvas of montage %s: %s", montage.Config.Name, err)
-		return nil, err
+		logrus.Errorf("montage.ExportMontage Error encoding canvas of montage %s: %s", config.Name, err)
+		return nil, nil, err
 	}
-	imageData := buf.Bytes()
-	// Save the final montage image file if a filename is given
+	montage.updateMutex.Lock()
+	montage.timings.Encode += time.Since(startTime)
+	montage.updateMutex.Unlock()
+	return imageData, renditionData, err
+}
 
-	return imageData, err
+// copyCanvas copies the canvas into the export canvas and returns the copy
+// Returns nil if the montage is released. The caller must hold the exportMutex.
+func (montage *Montage) copyCanvas() *image.RGBA {
+	montage.updateMutex.Lock()
+	defer montage.updateMutex.Unlock()
+	if montage.isReleased {
+		return nil
+	}
+	if montage.exportCanvas == nil || montage.exportCanvas.Rect != montage.canvas.Rect {
+		montage.exportCanvas = image.NewRGBA(montage.canvas.Rect)
+	}
+	copy(montage.exportCanvas.Pix, montage.canvas.Pix)
+	return montage.exportCanvas
+}
+
+// GetSourceImage returns the latest image data of the source of the placement with the given index
+// and the time it was drawn. Returns nil if the index is invalid or no image was received.
+func (montage *Montage) GetSourceImage(index int) ([]byte, time.Time) {
+	montage.updateMutex.Lock()
+	defer montage.updateMutex.Unlock()
+	if index < 0 || index >= len(montage.Config.ProposedPlacements) {
+		return nil, time.Time{}
+	}
+	source := montage.Config.ProposedPlacements[index].Source
+	return montage.sourceImages[source], montage.sourceUpdated[source]
+}
+
+// CanvasBytes returns the memory used by the canvas and its export copy
+func (montage *Montage) CanvasBytes() int {
+	montage.updateMutex.Lock()
+	defer montage.updateMutex.Unlock()
+	canvasBytes := 0
+	if montage.canvas != nil {
+		canvasBytes += len(montage.canvas.Pix)
+	}
+	if montage.exportCanvas != nil {
+		canvasBytes += len(montage.exportCanvas.Pix)
+	}
+	return canvasBytes
 }
 
 // UpdateImage writes image to canvas
-// This increments the UpdateCount when the image ID is recognized
+// This increments the UpdateCount when the image ID is recognized. An image that is identical
+// to the image shown for the source is not redrawn.
 func (montage *Montage) UpdateImage(source string, payload []byte) {
+	montage.updateMutex.Lock()
 	logrus.Debugf("montage.UpdateImage: source=%s for montage %s", source, montage.Config.Name)
+	if montage.isReleased {
+		montage.updateMutex.Unlock()
+		return
+	}
+	montage.recordSourceReceived(source)
+	// an identical image of a source that is shown doesn't change the canvas
+	payloadHash := sha1.Sum(payload)
+	if montage.sourceHashes[source] == payloadHash && !montage.staleSources[source] {
+		now := time.Now()
+		montage.sourceUpdated[source] = now
+		montage.recordSourceFrame(source, now)
+		montage.getSourceHealth(source).DuplicateFrames++
+		montage.updateMutex.Unlock()
+		logrus.Debugf("montage.UpdateImage: Skipped identical image of source %s", source)
+		return
+	}
+	montage.updateMutex.Unlock()
+
+	if montage.updateSourceSize(source, payload) {
+		// the new layout is drawn with the cached images before the new image is drawn
+		montage.rebuild(nil)
+	}
+	if montage.drawSource(source, payload) {
+		now := time.Now()
+		montage.updateMutex.Lock()
+		montage.sourceUpdated[source] = now
+		montage.sourceHashes[source] = payloadHash
+		delete(montage.staleSources, source)
+		montage.changedSources[source] = true
+		montage.recordSourceFrame(source, now)
+		montage.updateMutex.Unlock()
+	}
+}
+
+// updateSourceSize records the image size of the source for the justified layout
+// Returns true if the size has changed and the montage needs a new layout.
+func (montage *Montage) updateSourceSize(source string, payload []byte) bool {
+	if montage.getConfig().Layout != MontageLayoutJustified {
+		return false
+	}
+	imageConfig, _, err := image.DecodeConfig(bytes.NewReader(payload))
+	if err != nil {
+		return false
+	}
+	size := image.Pt(imageConfig.Width, imageConfig.Height)
+	montage.updateMutex.Lock()
+	defer montage.updateMutex.Unlock()
+	if montage.sourceSizes[source] == size {
+		return false
+	}
+	logrus.Infof("montage.updateSourceSize: Source %s of montage %s has size %dx%d",
+		source, montage.Config.Name, size.X, size.Y)
+	montage.sourceSizes[source] = size
+	return true
+}
+
+// drawSource draws the image data of a source into each placement that uses the source
+// Placements that overlap and are on top of the updated placement are redrawn from their latest image.
+// Returns true if the image was drawn successfully. If the layout is rebuilt while drawing, the
+// image is drawn again in the new layout. The drawn image is kept for redrawing the source.
+func (montage *Montage) drawSource(source string, payload []byte) bool {
+	montage.updateMutex.Lock()
+	placements := montage.actualPlacement
+	layoutVersion := montage.layoutVersion
+	montage.updateMutex.Unlock()
 
-	for _, placement := range montage.actualPlacement {
+	drawn := false
+	for index, placement := range placements {
 		// Finish the loop.
 		// It is possible that multiple layouts use the same source, for example one image is zoomed in.
 		if placement.Source == source {
-			if montage.useLibJpeg {
-				_ = montage.DrawImageIntoLayout(&placement, payload)
-			} else {
-				_ = montage.DrawImageIntoLayout(&placement, payload)
+			err := montage.drawPlacement(&placement, payload, layoutVersion)
+			if err == errLayoutChanged {
+				return montage.drawSource(source, payload)
+			}
+			drawn = drawn || err == nil
+			if err == nil {
+				montage.redrawOverlapping(placements, index, layoutVersion)
 			}
 		}
 	}
+	if drawn {
+		// keep the shown image for redrawing the source after the layout is rebuilt
+		montage.updateMutex.Lock()
+		isLayoutChanged := montage.layoutVersion != layoutVersion
+		if !isLayoutChanged && !montage.isReleased {
+			montage.sourceImages[source] = payload
+		}
+		montage.updateMutex.Unlock()
+		if isLayoutChanged {
+			return montage.drawSource(source, payload)
+		}
+	}
+	return drawn
+}
+
+// drawPlacement draws the image data into the placement of the layout with the given version
+func (montage *Montage) drawPlacement(placement *ImagePlacement, payload []byte, layoutVersion int) error {
+	img, err := montage.decodeImage(placement, payload)
+	if err != nil {
+		return err
+	}
+	return montage.drawImage(img, placement, layoutVersion)
+}
+
+// redrawOverlapping redraws the placements that are on top of the placement with the given index
+// using the latest image of their source, or the missing image if their source is stale.
+func (montage *Montage) redrawOverlapping(placements []ImagePlacement, index int, layoutVersion int) {
+	below := placements[index]
+	belowRect := image.Rect(below.X, below.Y, below.X+below.Width, below.Y+below.Height)
+	for _, above := range placements[index+1:] {
+		aboveRect := image.Rect(above.X, above.Y, above.X+above.Width, above.Y+above.Height)
+		if above.Source == below.Source || !aboveRect.Overlaps(belowRect) {
+			continue
+		}
+		montage.updateMutex.Lock()
+		payload, found := montage.sourceImages[above.Source]
+		isStale := montage.staleSources[above.Source]
+		montage.updateMutex.Unlock()
+		if isStale {
+			montage.drawTile(montage.makeMissingTile(above.Width, above.Height), &above, layoutVersion)
+		} else if found {
+			_ = montage.drawPlacement(&above, payload, layoutVersion)
+		}
+	}
+}
+
+// UpdateStaleImages replaces the images of sources that have not reported or whose last
+// update is older than the configured MaxAge with the missing image.
+// This increments the UpdateCount if any placement changed.
+func (montage *Montage) UpdateStaleImages(now time.Time) {
+	if montage.drawMissingImages(now) > 0 {
+		montage.updateMutex.Lock()
+		montage.markUpdated()
+		montage.updateMutex.Unlock()
+	}
+}
+
+// drawMissingImages draws the missing image in the placements of sources that have not
+// reported or are stale, and haven't already been replaced.
+// Returns the number of placements that were drawn.
+func (montage *Montage) drawMissingImages(now time.Time) int {
+	montage.updateMutex.Lock()
+	placements := montage.actualPlacement
+	layoutVersion := montage.layoutVersion
+	name := montage.Config.Name
+	maxAge := time.Duration(montage.Config.MaxAge) * time.Second
+	staleSources := make(map[string]bool)
+	for _, placement := range placements {
+		if montage.staleSources[placement.Source] {
+			continue
+		}
+		updated, hasUpdate := montage.sourceUpdated[placement.Source]
+		if !hasUpdate || (maxAge > 0 && now.Sub(updated) > maxAge) {
+			staleSources[placement.Source] = true
+			montage.staleSources[placement.Source] = true
+			montage.changedSources[placement.Source] = true
+			montage.setSourceHealthy(montage.getSourceHealth(placement.Source), false, now)
+		}
+	}
+	montage.updateMutex.Unlock()
+
+	drawCount := 0
+	for index, placement := range placements {
+		if staleSources[placement.Source] {
+			logrus.Infof("montage.drawMissingImages: source %s of montage %s has no recent image",
+				placement.Source, name)
+			montage.drawTile(montage.makeMissingTile(placement.Width, placement.Height), &placement, layoutVersion)
+			montage.redrawOverlapping(placements, index, layoutVersion)
+			drawCount++
+		}
+	}
+	return drawCount
+}
+
+// drawTile draws the image in the placement rectangle without updating the UpdateCount
+// The tile is not drawn if the layout was rebuilt since layoutVersion.
+func (montage *Montage) drawTile(tile image.Image, placement *ImagePlacement, layoutVersion int) {
+	rectangle := image.Rect(placement.X, placement.Y, placement.X+placement.Width, placement.Y+placement.Height)
+	montage.updateMutex.Lock()
+	defer montage.updateMutex.Unlock()
+	if montage.isReleased || layoutVersion != montage.layoutVersion {
+		return
+	}
+	draw.Draw(montage.canvas, rectangle, tile, image.ZP, draw.Src)
+}
+
+// makeMissingTile returns the image of the given size to show in place of a missing image
+// This is the configured missing image scaled to size, or a generated 'no signal' image.
+func (montage *Montage) makeMissingTile(width int, height int) image.Image {
+	if width <= 0 || height <= 0 {
+		return image.NewRGBA(image.Rect(0, 0, 0, 0))
+	}
+	if montage.missingImage != nil {
+		return imaging.Resize(montage.missingImage, width, height, montage.resizing)
+	}
+	tile := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(tile, tile.Bounds(), &image.Uniform{C: color.RGBA{R: 48, G: 48, B: 48, A: 255}}, image.ZP, draw.Src)
+	text := "NO SIGNAL"
+	face := basicfont.Face7x13
+	drawer := font.Drawer{
+		Dst:  tile,
+		Src:  image.NewUniform(color.RGBA{R: 160, G: 160, B: 160, A: 255}),
+		Face: face,
+	}
+	textWidth := drawer.MeasureString(text).Round()
+	drawer.Dot = fixed.P((width-textWidth)/2, (height+face.Ascent)/2)
+	drawer.DrawString(text)
+	return tile
+}
+
+// loadMissingImage loads the image to substitute for missing images
+// Returns nil if no image is configured or it cannot be loaded.
+func loadMissingImage(filename string) image.Image {
+	if filename == "" {
+		return nil
+	}
+	img, err := imaging.Open(filename)
+	if err != nil {
+		logrus.Errorf("loadMissingImage: Unable to load missing image '%s'. Using generated image instead: %s", filename, err)
+		return nil
+	}
+	return img
 }
 
-// WriteToFile writes the montage image to the given filename
+// WriteToFile writes the montage image in the configured format to the given filename
+// The extension of the filename is changed to match the format. The file is replaced atomically
+// and has the configured file mode.
 func (montage *Montage) WriteToFile(filename string) error {
-	jpegData, err := montage.ExportMontageAsJPEG()
-	err = ioutil.WriteFile(filename, jpegData, os.ModePerm)
-	return err
-}
-
-// MakeGridLayout calculates the actual placement of each image in the montage configuration
-// returns a new layout with actual location and size of each image
-// This is a simple grid layout, not optimizing for individual image sizes
-func MakeGridLayout(config *MontageConfig) []ImagePlacement {
-
-	cols := (len(config.ProposedPlacements) + (config.Rows - 1)) / config.Rows
-	if cols < 1 {
-		cols = 1
-	}
-	rows := config.Rows
-	// Leave room for the border
-	imageWidth := 0
-	imageHeight := int((config.Height-config.Border)/rows) - config.Border
-
-	result := make([]ImagePlacement, 0)
-	x := config.Border
-	y := config.Border
-	index := 0
-	// filename := ""
-	for r := 0; r < rows; r++ {
-		x = config.Border
-		for c := 0; c < cols; c++ {
-			if index < len(config.ProposedPlacements) {
-				// determine the image width in one of two ways, configured width or remaining space
-				imageConfig := config.ProposedPlacements[index]
-				// filename = montage.getTopicFilename(imageConfig.Topic)
-				resizeMethod := config.Resize
-				if imageConfig.Resize != "" {
-					resizeMethod = imageConfig.Resize
-				}
-				//if imageConfig.X > 0 {
-				//	// force x-offset
-				//	x = imageConfig.X
-				//}
-				//if imageConfig.Y > 0 {
-				//	// force y-offset
-				//	y = imageConfig.Y
-				//}
-				if imageConfig.Width > 0 {
-					// force image width
-					imageWidth = imageConfig.Width
-				} else {
-					// space evenly in remaining width. TODO: Actual imageWidth/Height is the remainder after all fixed widths
-					remainingCols := cols - c
-					remainingWidth := config.Width - x - config.Border*remainingCols
-					imageWidth = remainingWidth / remainingCols
-				}
-
-				imageLayout := ImagePlacement{
-					Source: imageConfig.Source,
-					X:      x + imageConfig.X,
-					Y:      y + imageConfig.Y,
-					Width:  imageWidth,
-					Height: imageHeight,
-					Resize: resizeMethod,
-				}
-				result = append(result, imageLayout)
-			}
-			index++
-			x += imageWidth + config.Border
+	config := montage.getConfig()
+	imageData, err := montage.ExportMontage()
+	if err != nil {
+		return err
+	}
+	mode, err := parseFileMode(config.FileMode)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(config.ImageFilename(filename), imageData, mode)
+}
+
+// Reconfigure applies a new configuration to the montage
+// This rebuilds the canvas and actual placement and redraws the latest image of each source
+func (montage *Montage) Reconfigure(config *MontageConfig) {
+	montage.rebuild(config)
+}
+
+// rebuild rebuilds the canvas and actual placement and redraws the latest image of each source
+// The new configuration is applied if given, otherwise the current configuration is used.
+func (montage *Montage) rebuild(newConfig *MontageConfig) {
+	montage.updateMutex.Lock()
+	if montage.isReleased {
+		montage.updateMutex.Unlock()
+		return
+	}
+	if newConfig != nil {
+		montage.Config = *newConfig
+	}
+	config := &montage.Config
+	logrus.Infof("montage.rebuild: montage %s, %dx%d, %d rows", config.Name, config.Width, config.Height, config.Rows)
+	montage.actualPlacement = MakeLayout(config, montage.sourceSizes)
+	montage.background = loadBackground(config)
+	montage.canvas = newCanvas(config.Width, config.Height, montage.background)
+	montage.layoutVersion++
+	montage.missingImage = loadMissingImage(config.MissingImage)
+	montage.staleSources = make(map[string]bool)
+	// keep the latest image of the sources that remain in use
+	usedSources := make(map[string]bool)
+	for _, imageConfig := range config.ProposedPlacements {
+		usedSources[imageConfig.Source] = true
+	}
+	sourceImages := make(map[string][]byte, len(montage.sourceImages))
+	for source, payload := range montage.sourceImages {
+		if usedSources[source] {
+			sourceImages[source] = payload
+		} else {
+			delete(montage.sourceImages, source)
+			delete(montage.sourceUpdated, source)
+			delete(montage.sourceHashes, source)
+			delete(montage.sourceSizes, source)
+			delete(montage.sourceHealth, source)
 		}
-		y += imageHeight + config.Border
 	}
-	return result
+	// ensure the new (blank) canvas is exported even if no images are drawn
+	montage.layoutChanged = true
+	montage.markUpdated()
+	montage.updateMutex.Unlock()
+
+	for source, payload := range sourceImages {
+		montage.drawSource(source, payload)
+	}
+	montage.drawMissingImages(time.Now())
+}
+
+// Release releases the canvas and cached images of a montage that is no longer used
+// Updates and exports of a released montage are ignored.
+func (montage *Montage) Release() {
+	montage.exportMutex.Lock()
+	defer montage.exportMutex.Unlock()
+	montage.updateMutex.Lock()
+	defer montage.updateMutex.Unlock()
+	logrus.Infof("montage.Release: montage %s", montage.Config.Name)
+	montage.isReleased = true
+	montage.canvas = nil
+	montage.exportCanvas = nil
+	montage.actualPlacement = nil
+	montage.missingImage = nil
+	montage.sourceImages = make(map[string][]byte)
+	montage.sourceUpdated = make(map[string]time.Time)
+	montage.sourceHashes = make(map[string][sha1.Size]byte)
+	montage.sourceSizes = make(map[string]image.Point)
+	montage.staleSources = make(map[string]bool)
+	montage.sourceHealth = make(map[string]*SourceHealth)
+	montage.healthChanges = nil
+	montage.changedSources = make(map[string]bool)
+	montage.UpdateCount = 0
 }
 
 // NewMontage initialises a new Montage instance for the given Config
 // This calculates the actual placement based on the image sizes from the config
 func NewMontage(config *MontageConfig, useLibJpeg bool) *Montage {
-	actualPlacement := MakeGridLayout(config)
+	actualPlacement := MakeLayout(config, nil)
+	background := loadBackground(config)
 
 	builder := Montage{
 		Config:     *config,
@@ -297,10 +883,25 @@ func NewMontage(config *MontageConfig, useLibJpeg bool) *Montage {
 		//Resizing: imaging.Welch,               // good, 147ms
 
 		// setup the canvas to draw the images onto
-		canvas:          image.NewRGBA(image.Rect(0, 0, config.Width, config.Height)),
+		canvas:          newCanvas(config.Width, config.Height, background),
+		background:      background,
 		actualPlacement: actualPlacement,
+		sourceImages:    make(map[string][]byte),
+		sourceUpdated:   make(map[string]time.Time),
+		sourceHashes:    make(map[string][sha1.Size]byte),
+		staleSources:    make(map[string]bool),
+		sourceSizes:     make(map[string]image.Point),
+		sourceHealth:    make(map[string]*SourceHealth),
+		changedSources:  make(map[string]bool),
+		missingImage:    loadMissingImage(config.MissingImage),
 	}
-	rgbaBlack := color.NRGBA{R: 0, G: 0, B: 0, A: 0}
-	draw.Draw(builder.canvas, builder.canvas.Bounds(), &image.Uniform{C: rgbaBlack}, image.ZP, draw.Src)
+	builder.drawMissingImages(time.Now())
 	return &builder
 }
+
+// newCanvas creates a canvas of the given size and background color to draw the montage on
+func newCanvas(width int, height int, background color.Color) *image.RGBA {
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(canvas, canvas.Bounds(), &image.Uniform{C: background}, image.ZP, draw.Src)
+	return canvas
+}
@@ -0,0 +1,134 @@
+// Package internal with the output formats of the montage image
+package internal
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	libjpeg "github.com/pixiv/go-libjpeg/jpeg"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// MontageFormat is the image format of the montage image
+type MontageFormat string
+
+// Montage image formats. PNG, BMP and TIFF are lossless.
+const (
+	MontageFormatJPEG MontageFormat = "jpeg"
+	MontageFormatPNG  MontageFormat = "png"
+	MontageFormatBMP  MontageFormat = "bmp"
+	MontageFormatTIFF MontageFormat = "tiff"
+)
+
+// DefaultJPEGQuality is the JPEG quality if no quality is configured
+const DefaultJPEGQuality = 80
+
+// montageFormatInfo holds the file extension and content type of each format
+var montageFormatInfo = map[MontageFormat]struct {
+	ext         string
+	contentType string
+}{
+	"":                {".jpg", "image/jpeg"},
+	MontageFormatJPEG: {".jpg", "image/jpeg"},
+	MontageFormatPNG:  {".png", "image/png"},
+	MontageFormatBMP:  {".bmp", "image/bmp"},
+	MontageFormatTIFF: {".tiff", "image/tiff"},
+}
+
+// MontageRendition is an additional output of the montage image in another size or format
+// Each rendition is published on the image output with the rendition name as instance.
+type MontageRendition struct {
+	Name     string        `yaml:"name"`               // name of the rendition, used as output instance
+	Width    int           `yaml:"width,omitempty"`    // width of the rendition. Default 0 keeps the aspect ratio
+	Height   int           `yaml:"height,omitempty"`   // height of the rendition. Default 0 keeps the aspect ratio
+	Format   MontageFormat `yaml:"format,omitempty"`   // Image format: 'jpeg', 'png', 'bmp' or 'tiff'. Default is jpeg
+	Quality  int           `yaml:"quality,omitempty"`  // JPEG quality 1-100. Default is 80
+	Filename string        `yaml:"filename,omitempty"` // file to save the rendition as
+	Publish  bool          `yaml:"publish"`            // publish the rendition image
+}
+
+// renditionImage scales the montage canvas to the size of the rendition
+// When both width and height are set, the canvas is scaled and cropped to fill the size.
+func renditionImage(canvas image.Image, rendition *MontageRendition, filter imaging.ResampleFilter) image.Image {
+	if rendition.Width > 0 && rendition.Height > 0 {
+		return imaging.Fill(canvas, rendition.Width, rendition.Height, imaging.Center, filter)
+	}
+	return imaging.Resize(canvas, rendition.Width, rendition.Height, filter)
+}
+
+// renditionConfig returns the montage configuration to encode a rendition with
+func renditionConfig(config *MontageConfig, rendition *MontageRendition) *MontageConfig {
+	encodeConfig := *config
+	encodeConfig.Format = rendition.Format
+	encodeConfig.Quality = rendition.Quality
+	return &encodeConfig
+}
+
+// FileExt returns the file extension of the format, including the dot
+func (format MontageFormat) FileExt() string {
+	return montageFormatInfo[format].ext
+}
+
+// ContentType returns the MIME type of the format
+func (format MontageFormat) ContentType() string {
+	return montageFormatInfo[format].contentType
+}
+
+// imageExtFormats holds the image format of each image file extension
+var imageExtFormats = map[string]MontageFormat{
+	".jpg": MontageFormatJPEG, ".jpeg": MontageFormatJPEG, ".png": MontageFormatPNG,
+	".bmp": MontageFormatBMP, ".tif": MontageFormatTIFF, ".tiff": MontageFormatTIFF,
+}
+
+// ImageFilename returns the filename with the extension of another image format replaced by the
+// extension of the configured format. Filenames with an extension of the configured format, such
+// as .jpeg for jpeg, or without image extension are not changed.
+func (config *MontageConfig) ImageFilename(filename string) string {
+	format := config.Format
+	if format == "" {
+		format = MontageFormatJPEG
+	}
+	extFormat, isImageExt := imageExtFormats[strings.ToLower(filepath.Ext(filename))]
+	if !isImageExt || extFormat == format {
+		return filename
+	}
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + format.FileExt()
+}
+
+// encodeImage encodes the image in the configured format
+func encodeImage(img image.Image, config *MontageConfig, useLibJpeg bool) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	var err error
+	quality := config.Quality
+	if quality == 0 {
+		quality = DefaultJPEGQuality
+	}
+	switch config.Format {
+	case MontageFormatPNG:
+		err = png.Encode(buf, img)
+	case MontageFormatBMP:
+		err = bmp.Encode(buf, img)
+	case MontageFormatTIFF:
+		err = tiff.Encode(buf, img, &tiff.Options{Compression: tiff.Deflate})
+	default:
+		// progressive and optimized JPEG are only supported by libjpeg
+		if useLibJpeg || config.Progressive || config.Optimize {
+			opt := libjpeg.EncoderOptions{}
+			opt.Quality = quality
+			opt.ProgressiveMode = config.Progressive
+			opt.OptimizeCoding = config.Optimize
+			err = libjpeg.Encode(buf, img, &opt)
+		} else {
+			var opt jpeg.Options
+			opt.Quality = quality
+			err = jpeg.Encode(buf, img, &opt)
+		}
+	}
+	return buf.Bytes(), err
+}
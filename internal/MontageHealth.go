@@ -0,0 +1,115 @@
+// Package internal with health tracking of montage image sources
+package internal
+
+import (
+	"time"
+)
+
+// frameRateSmoothing is the weight of the latest frame interval in the average frame rate
+const frameRateSmoothing = 0.2
+
+// SourceHealth holds the health of an image source of a montage
+type SourceHealth struct {
+	Source          string    // source of the image placement
+	Healthy         bool      // the source delivers images that are not stale
+	LastUpdate      time.Time // time of the last successfully drawn image, zero if none
+	LastError       string    // last error drawing an image of the source, empty if none
+	FramesReceived  int       // number of images received from the source
+	DuplicateFrames int       // number of received images that were identical to the image shown
+	DecodeFailures  int       // number of images of the source that failed to decode
+	FrameRate       float64   // average number of images per second, 0 when stale
+	frameInterval   float64   // average interval in seconds between images
+}
+
+// SourceHealthChange is a transition of a source between healthy and stale
+type SourceHealthChange struct {
+	Source    string    `json:"source"`
+	Healthy   bool      `json:"healthy"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// getSourceHealth returns the health record of a source and creates it if needed
+// The caller must hold the updateMutex.
+func (montage *Montage) getSourceHealth(source string) *SourceHealth {
+	health := montage.sourceHealth[source]
+	if health == nil {
+		health = &SourceHealth{Source: source}
+		montage.sourceHealth[source] = health
+	}
+	return health
+}
+
+// setSourceHealthy records a transition of a source between healthy and stale
+// The caller must hold the updateMutex.
+func (montage *Montage) setSourceHealthy(health *SourceHealth, healthy bool, now time.Time) {
+	if health.Healthy == healthy {
+		return
+	}
+	health.Healthy = healthy
+	if !healthy {
+		health.FrameRate = 0
+		health.frameInterval = 0
+	}
+	montage.healthChanges = append(montage.healthChanges, SourceHealthChange{
+		Source: health.Source, Healthy: healthy, Timestamp: now})
+}
+
+// recordSourceFrame records an image of the source that was drawn successfully
+// The caller must hold the updateMutex.
+func (montage *Montage) recordSourceFrame(source string, now time.Time) {
+	health := montage.getSourceHealth(source)
+	if health.Healthy && !health.LastUpdate.IsZero() {
+		interval := now.Sub(health.LastUpdate).Seconds()
+		if health.frameInterval == 0 {
+			health.frameInterval = interval
+		} else {
+			health.frameInterval += frameRateSmoothing * (interval - health.frameInterval)
+		}
+		if health.frameInterval > 0 {
+			health.FrameRate = 1 / health.frameInterval
+		}
+	}
+	health.LastUpdate = now
+	health.LastError = ""
+	montage.setSourceHealthy(health, true, now)
+}
+
+// recordSourceReceived records an image received from the source
+// The caller must hold the updateMutex.
+func (montage *Montage) recordSourceReceived(source string) {
+	montage.getSourceHealth(source).FramesReceived++
+}
+
+// recordSourceError records an image of the source that could not be drawn
+func (montage *Montage) recordSourceError(source string, err error, isDecodeError bool) {
+	montage.updateMutex.Lock()
+	defer montage.updateMutex.Unlock()
+	if montage.isReleased {
+		return
+	}
+	health := montage.getSourceHealth(source)
+	health.LastError = err.Error()
+	if isDecodeError {
+		health.DecodeFailures++
+	}
+}
+
+// GetSourceHealth returns a copy of the health of each source of the montage
+func (montage *Montage) GetSourceHealth() map[string]SourceHealth {
+	montage.updateMutex.Lock()
+	defer montage.updateMutex.Unlock()
+	healthMap := make(map[string]SourceHealth, len(montage.sourceHealth))
+	for source, health := range montage.sourceHealth {
+		healthMap[source] = *health
+	}
+	return healthMap
+}
+
+// TakeHealthChanges returns the source transitions between healthy and stale since the last call and clears them
+func (montage *Montage) TakeHealthChanges() []SourceHealthChange {
+	montage.updateMutex.Lock()
+	defer montage.updateMutex.Unlock()
+	changes := montage.healthChanges
+	montage.healthChanges = nil
+	return changes
+}
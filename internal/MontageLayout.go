@@ -0,0 +1,547 @@
+// Package internal with montage layouts
+package internal
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MontageLayout method of laying out images on the canvas
+type MontageLayout string
+
+// Available montage layouts
+const (
+	MontageLayoutFree      MontageLayout = "free"
+	MontageLayoutGrid      MontageLayout = "grid"
+	MontageLayoutJustified MontageLayout = "justified"
+	// Templates with large and small views
+	MontageLayout1Plus5    MontageLayout = "1+5"
+	MontageLayout1Plus7    MontageLayout = "1+7"
+	MontageLayout2Plus8    MontageLayout = "2+8"
+	MontageLayoutSideStrip MontageLayout = "side-strip"
+)
+
+// layoutSlot is a slot of a layout template in grid cells
+type layoutSlot struct {
+	col, row         int // top left cell of the slot
+	colSpan, rowSpan int // number of cells covered by the slot
+}
+
+// layoutTemplate is a layout of slots on a grid of cells
+// The first slot is the primary slot.
+type layoutTemplate struct {
+	cols, rows int
+	slots      []layoutSlot
+}
+
+// layoutTemplates holds the fixed layout templates
+var layoutTemplates = map[MontageLayout]layoutTemplate{
+	// one large view with a strip of 5 small views on the right and bottom
+	MontageLayout1Plus5: {cols: 3, rows: 3, slots: []layoutSlot{
+		{0, 0, 2, 2},
+		{2, 0, 1, 1}, {2, 1, 1, 1},
+		{0, 2, 1, 1}, {1, 2, 1, 1}, {2, 2, 1, 1},
+	}},
+	// one large view with a strip of 7 small views on the right and bottom
+	MontageLayout1Plus7: {cols: 4, rows: 4, slots: []layoutSlot{
+		{0, 0, 3, 3},
+		{3, 0, 1, 1}, {3, 1, 1, 1}, {3, 2, 1, 1},
+		{0, 3, 1, 1}, {1, 3, 1, 1}, {2, 3, 1, 1}, {3, 3, 1, 1},
+	}},
+	// two large views on top with 8 small views below
+	MontageLayout2Plus8: {cols: 4, rows: 4, slots: []layoutSlot{
+		{0, 0, 2, 2}, {2, 0, 2, 2},
+		{0, 2, 1, 1}, {1, 2, 1, 1}, {2, 2, 1, 1}, {3, 2, 1, 1},
+		{0, 3, 1, 1}, {1, 3, 1, 1}, {2, 3, 1, 1}, {3, 3, 1, 1},
+	}},
+}
+
+// DefaultAspectRatio is the aspect ratio of sources whose image size is not yet known
+const DefaultAspectRatio = 16.0 / 9.0
+
+// Units of the position and size of image placements in free layout
+const (
+	PlacementUnitPercent = "%"
+	PlacementUnitPixel   = "px"
+)
+
+// MakeLayout calculates the actual placement of each image using the configured layout
+// The sourceSizes hold the image size of each source that has reported, for use by layouts that
+// adapt to the image aspect ratio.
+// Layout errors are logged and the placements are constrained to the canvas.
+func MakeLayout(config *MontageConfig, sourceSizes map[string]image.Point) []ImagePlacement {
+	switch config.Layout {
+	case MontageLayoutJustified:
+		return MakeJustifiedLayout(config, sourceSizes)
+	case MontageLayoutFree:
+		placements, err := MakeFreeLayout(config)
+		if err != nil {
+			logrus.Errorf("MakeLayout: Montage %s: %s", config.Name, err)
+		}
+		return placements
+	case MontageLayout1Plus5, MontageLayout1Plus7, MontageLayout2Plus8, MontageLayoutSideStrip:
+		return MakeTemplateLayout(config)
+	case MontageLayoutGrid, "":
+		return MakeGridLayout(config)
+	default:
+		logrus.Errorf("MakeLayout: Montage %s has unknown layout '%s'. Using grid layout", config.Name, config.Layout)
+		return MakeGridLayout(config)
+	}
+}
+
+// newPlacement returns the actual placement of an image at the given location on the canvas
+// The resize method and alignment of the image default to those of the montage.
+func newPlacement(config *MontageConfig, imageConfig *ImagePlacement, rect image.Rectangle) ImagePlacement {
+	resizeMethod := config.Resize
+	if imageConfig.Resize != "" {
+		resizeMethod = imageConfig.Resize
+	}
+	align := config.Align
+	if imageConfig.Align != "" {
+		align = imageConfig.Align
+	}
+	return ImagePlacement{
+		Source: imageConfig.Source,
+		X:      rect.Min.X,
+		Y:      rect.Min.Y,
+		Width:  rect.Dx(),
+		Height: rect.Dy(),
+		Resize: resizeMethod,
+		Align:  align,
+	}
+}
+
+// offsetInCell returns the rectangle of a grid cell moved by the x/y offset of the image and
+// clipped to the cell, so an offset image doesn't cover its neighbours or leave the canvas.
+func offsetInCell(cell image.Rectangle, imageConfig *ImagePlacement) image.Rectangle {
+	return cell.Add(image.Pt(imageConfig.X, imageConfig.Y)).Intersect(cell)
+}
+
+// freePlacementRect returns the rectangle on the canvas of an image placement in free layout
+// A width or height of 0 extends the image to the edge of the canvas.
+func freePlacementRect(config *MontageConfig, imageConfig *ImagePlacement) (image.Rectangle, error) {
+	x, y, width, height := imageConfig.X, imageConfig.Y, imageConfig.Width, imageConfig.Height
+	switch imageConfig.Unit {
+	case PlacementUnitPixel, "":
+	case PlacementUnitPercent:
+		x = x * config.Width / 100
+		y = y * config.Height / 100
+		width = width * config.Width / 100
+		height = height * config.Height / 100
+	default:
+		return image.Rectangle{}, fmt.Errorf("image '%s' has unknown unit '%s'", imageConfig.Source, imageConfig.Unit)
+	}
+	if width == 0 {
+		width = config.Width - x
+	}
+	if height == 0 {
+		height = config.Height - y
+	}
+	return image.Rect(x, y, x+width, y+height), nil
+}
+
+// MakeFreeLayout calculates the actual placement of each image using the absolute position
+// and size of each image from the configuration. Later images are drawn on top of earlier images,
+// which supports picture-in-picture layouts.
+// Placements outside the canvas are clipped to the canvas and reported in the returned error.
+func MakeFreeLayout(config *MontageConfig) ([]ImagePlacement, error) {
+	canvasRect := image.Rect(0, 0, config.Width, config.Height)
+	result := make([]ImagePlacement, 0, len(config.ProposedPlacements))
+	errorMessages := make([]string, 0)
+
+	for index := range config.ProposedPlacements {
+		imageConfig := &config.ProposedPlacements[index]
+		rect, err := freePlacementRect(config, imageConfig)
+		if err != nil {
+			errorMessages = append(errorMessages, err.Error())
+			continue
+		}
+		if rect.Empty() || !rect.In(canvasRect) {
+			errorMessages = append(errorMessages, fmt.Sprintf("image '%s' at %v is outside the %dx%d canvas",
+				imageConfig.Source, rect, config.Width, config.Height))
+			rect = rect.Intersect(canvasRect)
+		}
+		result = append(result, newPlacement(config, imageConfig, rect))
+	}
+	if len(errorMessages) > 0 {
+		return result, fmt.Errorf("invalid free layout: %s", strings.Join(errorMessages, "; "))
+	}
+	return result, nil
+}
+
+// MakeGridLayout calculates the actual placement of each image in the montage configuration
+// returns a new layout with actual location and size of each image
+// This is a simple grid layout, not optimizing for individual image sizes
+// Montages with row or column weights, or images that span multiple cells use MakeSpanGridLayout.
+func MakeGridLayout(config *MontageConfig) []ImagePlacement {
+	if hasGridSpans(config) {
+		return MakeSpanGridLayout(config)
+	}
+
+	rows := config.Rows
+	if rows < 1 {
+		rows = 1
+	}
+	cols := (len(config.ProposedPlacements) + (rows - 1)) / rows
+	if cols < 1 {
+		cols = 1
+	}
+	// Leave room for the border
+	imageWidth := 0
+	imageHeight := int((config.Height-config.Border)/rows) - config.Border
+
+	result := make([]ImagePlacement, 0)
+	x := config.Border
+	y := config.Border
+	index := 0
+	// filename := ""
+	for r := 0; r < rows; r++ {
+		x = config.Border
+		for c := 0; c < cols; c++ {
+			if index < len(config.ProposedPlacements) {
+				// determine the image width in one of two ways, configured width or remaining space
+				imageConfig := config.ProposedPlacements[index]
+				// filename = montage.getTopicFilename(imageConfig.Topic)
+				//if imageConfig.X > 0 {
+				//	// force x-offset
+				//	x = imageConfig.X
+				//}
+				//if imageConfig.Y > 0 {
+				//	// force y-offset
+				//	y = imageConfig.Y
+				//}
+				if imageConfig.Width > 0 {
+					// force image width
+					imageWidth = imageConfig.Width
+				} else {
+					// space evenly in remaining width. TODO: Actual imageWidth/Height is the remainder after all fixed widths
+					remainingCols := cols - c
+					remainingWidth := config.Width - x - config.Border*remainingCols
+					imageWidth = remainingWidth / remainingCols
+				}
+
+				cell := image.Rect(x, y, x+imageWidth, y+imageHeight)
+				imageLayout := newPlacement(config, &imageConfig, offsetInCell(cell, &imageConfig))
+				result = append(result, imageLayout)
+			}
+			index++
+			x += imageWidth + config.Border
+		}
+		y += imageHeight + config.Border
+	}
+	return result
+}
+
+// MakeJustifiedLayout calculates the actual placement of each image in justified rows
+// Images keep their order and each row is scaled so that its images have the same height and
+// together fill the row width. The number of rows is chosen to maximize the area covered by images.
+// Images are placed using their native aspect ratio from sourceSizes. Sources without a known size
+// use the DefaultAspectRatio.
+func MakeJustifiedLayout(config *MontageConfig, sourceSizes map[string]image.Point) []ImagePlacement {
+	count := len(config.ProposedPlacements)
+	aspects := make([]float64, count)
+	for index, imageConfig := range config.ProposedPlacements {
+		aspects[index] = DefaultAspectRatio
+		size, found := sourceSizes[imageConfig.Source]
+		if found && size.X > 0 && size.Y > 0 {
+			aspects[index] = float64(size.X) / float64(size.Y)
+		}
+	}
+	var bestRows [][]int
+	bestArea := -1.0
+	for rowCount := 1; rowCount <= count; rowCount++ {
+		rows := partitionRows(aspects, rowCount)
+		heights, scale := justifiedRowHeights(config, aspects, rows)
+		area := 0.0
+		for rowIndex, row := range rows {
+			for _, index := range row {
+				area += aspects[index] * heights[rowIndex] * heights[rowIndex] * scale * scale
+			}
+		}
+		if area > bestArea {
+			bestArea = area
+			bestRows = rows
+		}
+	}
+	return justifiedPlacements(config, aspects, bestRows)
+}
+
+// partitionRows divides the images in order over the given number of rows with a balanced
+// sum of aspect ratios in each row. Returns the image indices of each row.
+func partitionRows(aspects []float64, rowCount int) [][]int {
+	totalAspect := 0.0
+	for _, aspect := range aspects {
+		totalAspect += aspect
+	}
+	rows := make([][]int, 0, rowCount)
+	row := make([]int, 0)
+	cumulative := 0.0
+	for index, aspect := range aspects {
+		remainingImages := len(aspects) - index
+		remainingRows := rowCount - len(rows)
+		// close the row when it is closer to its target without this image, but keep an image for each remaining row
+		target := totalAspect * float64(len(rows)+1) / float64(rowCount)
+		closeRow := len(row) > 0 && remainingRows > 1 &&
+			(math.Abs(cumulative-target) < math.Abs(cumulative+aspect-target) || remainingImages < remainingRows)
+		if closeRow {
+			rows = append(rows, row)
+			row = make([]int, 0)
+		}
+		row = append(row, index)
+		cumulative += aspect
+	}
+	if len(row) > 0 {
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// justifiedRowHeights returns the height of each row when filling the canvas width, and the
+// scale needed for all rows to fit in the canvas height.
+func justifiedRowHeights(config *MontageConfig, aspects []float64, rows [][]int) (heights []float64, scale float64) {
+	heights = make([]float64, len(rows))
+	totalHeight := 0.0
+	for rowIndex, row := range rows {
+		rowAspect := 0.0
+		for _, index := range row {
+			rowAspect += aspects[index]
+		}
+		availableWidth := float64(config.Width - config.Border*(len(row)+1))
+		heights[rowIndex] = math.Max(0, availableWidth/rowAspect)
+		totalHeight += heights[rowIndex]
+	}
+	scale = 1.0
+	availableHeight := float64(config.Height - config.Border*(len(rows)+1))
+	if totalHeight > availableHeight && totalHeight > 0 {
+		scale = math.Max(0, availableHeight/totalHeight)
+	}
+	return heights, scale
+}
+
+// justifiedPlacements returns the placement of images in the given rows
+// Rows that are narrower than the canvas are centered horizontally and the rows are centered vertically.
+func justifiedPlacements(config *MontageConfig, aspects []float64, rows [][]int) []ImagePlacement {
+	heights, scale := justifiedRowHeights(config, aspects, rows)
+	result := make([]ImagePlacement, 0, len(aspects))
+	usedHeight := config.Border * (len(rows) + 1)
+	for rowIndex := range rows {
+		usedHeight += int(heights[rowIndex] * scale)
+	}
+	y := config.Border + (config.Height-usedHeight)/2
+	for rowIndex, row := range rows {
+		rowHeight := int(heights[rowIndex] * scale)
+		widths := make([]int, len(row))
+		rowWidth := config.Border * (len(row) + 1)
+		for i, index := range row {
+			widths[i] = int(aspects[index] * heights[rowIndex] * scale)
+			rowWidth += widths[i]
+		}
+		// the last image absorbs rounding errors when the row fills the width
+		if scale >= 1.0 && len(row) > 0 {
+			widths[len(row)-1] += config.Width - rowWidth
+			rowWidth = config.Width
+		}
+		x := config.Border + (config.Width-rowWidth)/2
+		for i, index := range row {
+			imageConfig := &config.ProposedPlacements[index]
+			result = append(result, newPlacement(config, imageConfig, image.Rect(x, y, x+widths[i], y+rowHeight)))
+			x += widths[i] + config.Border
+		}
+		y += rowHeight + config.Border
+	}
+	return result
+}
+
+// sideStripTemplate returns a template with one large view and a vertical strip of small views
+// on the right that holds the remaining images.
+func sideStripTemplate(imageCount int) layoutTemplate {
+	stripCount := imageCount - 1
+	if stripCount < 1 {
+		stripCount = 1
+	}
+	template := layoutTemplate{cols: 4, rows: stripCount, slots: []layoutSlot{{0, 0, 3, stripCount}}}
+	for row := 0; row < stripCount; row++ {
+		template.slots = append(template.slots, layoutSlot{3, row, 1, 1})
+	}
+	return template
+}
+
+// primaryFirst returns the image configurations with the primary image first
+// The other images keep their order.
+func primaryFirst(placements []ImagePlacement) []ImagePlacement {
+	result := make([]ImagePlacement, 0, len(placements))
+	for index, imageConfig := range placements {
+		if imageConfig.Primary {
+			result = append(result, imageConfig)
+			result = append(result, placements[:index]...)
+			return append(result, placements[index+1:]...)
+		}
+	}
+	return append(result, placements...)
+}
+
+// cellEdges returns the pixel position of the edges between cells when dividing the given size
+// into cells of equal size. The border is included in each cell's leading edge.
+func cellEdges(size int, border int, cells int) []int {
+	return weightedCellEdges(size, border, nil, cells)
+}
+
+// weightedCellEdges returns the pixel position of the edges between cells when dividing the given
+// size into cells proportional to their weight. Cells without a positive weight have weight 1.
+// The border is included in each cell's leading edge.
+func weightedCellEdges(size int, border int, weights []float64, cells int) []int {
+	cellWeights := make([]float64, cells)
+	totalWeight := 0.0
+	for index := range cellWeights {
+		cellWeights[index] = 1
+		if index < len(weights) && weights[index] > 0 {
+			cellWeights[index] = weights[index]
+		}
+		totalWeight += cellWeights[index]
+	}
+	edges := make([]int, cells+1)
+	cumulative := 0.0
+	for index := range cellWeights {
+		cumulative += cellWeights[index]
+		edges[index+1] = int(math.Round(cumulative / totalWeight * float64(size-border)))
+	}
+	return edges
+}
+
+// MakeTemplateLayout calculates the actual placement of each image using a layout template
+// Images are assigned to the template slots in order, starting with the image that is marked
+// as primary. Configurations with more images than slots are rejected by Validate; when used
+// anyway, the images that do not fit are not shown.
+func MakeTemplateLayout(config *MontageConfig) []ImagePlacement {
+	template, found := layoutTemplates[config.Layout]
+	if config.Layout == MontageLayoutSideStrip {
+		template, found = sideStripTemplate(len(config.ProposedPlacements)), true
+	}
+	if !found {
+		logrus.Errorf("MakeTemplateLayout: Unknown layout template '%s'", config.Layout)
+		return make([]ImagePlacement, 0)
+	}
+	imageConfigs := primaryFirst(config.ProposedPlacements)
+	if len(imageConfigs) > len(template.slots) {
+		logrus.Warningf("MakeTemplateLayout: Montage %s has %d images but layout '%s' only has %d slots",
+			config.Name, len(imageConfigs), config.Layout, len(template.slots))
+		imageConfigs = imageConfigs[:len(template.slots)]
+	}
+	xEdges := cellEdges(config.Width, config.Border, template.cols)
+	yEdges := cellEdges(config.Height, config.Border, template.rows)
+
+	result := make([]ImagePlacement, 0, len(imageConfigs))
+	for index := range imageConfigs {
+		slot := template.slots[index]
+		rect := image.Rect(
+			xEdges[slot.col]+config.Border, yEdges[slot.row]+config.Border,
+			xEdges[slot.col+slot.colSpan], yEdges[slot.row+slot.rowSpan])
+		result = append(result, newPlacement(config, &imageConfigs[index], rect))
+	}
+	return result
+}
+
+// hasGridSpans returns true if the grid has weighted rows or columns, or images spanning multiple cells
+func hasGridSpans(config *MontageConfig) bool {
+	if len(config.RowWeights) > 0 || len(config.ColWeights) > 0 {
+		return true
+	}
+	for _, imageConfig := range config.ProposedPlacements {
+		if imageConfig.RowSpan > 1 || imageConfig.ColSpan > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// placementSpan returns the number of columns and rows covered by an image in the grid
+func placementSpan(imageConfig *ImagePlacement) (colSpan int, rowSpan int) {
+	colSpan, rowSpan = imageConfig.ColSpan, imageConfig.RowSpan
+	if colSpan < 1 {
+		colSpan = 1
+	}
+	if rowSpan < 1 {
+		rowSpan = 1
+	}
+	return colSpan, rowSpan
+}
+
+// MakeSpanGridLayout calculates the actual placement of each image in a grid where images can
+// span multiple rows and columns, and rows and columns are sized by their weight.
+// Images fill the first free cells in row order. Images that do not fit in the grid are not shown.
+func MakeSpanGridLayout(config *MontageConfig) []ImagePlacement {
+	rows := config.Rows
+	if rows < 1 {
+		rows = 1
+	}
+	// enough columns to hold all cells and the widest image
+	cellCount := 0
+	cols := len(config.ColWeights)
+	for index := range config.ProposedPlacements {
+		colSpan, rowSpan := placementSpan(&config.ProposedPlacements[index])
+		cellCount += colSpan * rowSpan
+		if colSpan > cols {
+			cols = colSpan
+		}
+	}
+	if (cellCount+rows-1)/rows > cols {
+		cols = (cellCount + rows - 1) / rows
+	}
+	occupied := make([][]bool, rows)
+	for row := range occupied {
+		occupied[row] = make([]bool, cols)
+	}
+	xEdges := weightedCellEdges(config.Width, config.Border, config.ColWeights, cols)
+	yEdges := weightedCellEdges(config.Height, config.Border, config.RowWeights, rows)
+
+	result := make([]ImagePlacement, 0, len(config.ProposedPlacements))
+	for index := range config.ProposedPlacements {
+		imageConfig := &config.ProposedPlacements[index]
+		colSpan, rowSpan := placementSpan(imageConfig)
+		col, row, found := findFreeCells(occupied, colSpan, rowSpan)
+		if !found {
+			logrus.Warningf("MakeSpanGridLayout: Image '%s' of montage %s does not fit in the %dx%d grid",
+				imageConfig.Source, config.Name, cols, rows)
+			continue
+		}
+		for r := row; r < row+rowSpan; r++ {
+			for c := col; c < col+colSpan; c++ {
+				occupied[r][c] = true
+			}
+		}
+		rect := image.Rect(
+			xEdges[col]+config.Border, yEdges[row]+config.Border,
+			xEdges[col+colSpan], yEdges[row+rowSpan])
+		result = append(result, newPlacement(config, imageConfig, offsetInCell(rect, imageConfig)))
+	}
+	return result
+}
+
+// findFreeCells returns the first column and row, in row order, where a block of free cells of
+// the given span is available.
+func findFreeCells(occupied [][]bool, colSpan int, rowSpan int) (col int, row int, found bool) {
+	for row = 0; row+rowSpan <= len(occupied); row++ {
+		for col = 0; col+colSpan <= len(occupied[row]); col++ {
+			if isFree(occupied, col, row, colSpan, rowSpan) {
+				return col, row, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// isFree returns true if all cells in the block are free
+func isFree(occupied [][]bool, col int, row int, colSpan int, rowSpan int) bool {
+	for r := row; r < row+rowSpan; r++ {
+		for c := col; c < col+colSpan; c++ {
+			if occupied[r][c] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -1,11 +1,17 @@
 package internal
 
 import (
-	"io/ioutil"
+	"crypto/sha1"
+	"net/http"
 	"os"
+	"path"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/iotdomain/iotdomain-go/publisher"
 	"github.com/iotdomain/iotdomain-go/types"
 	"github.com/sirupsen/logrus"
@@ -14,25 +20,67 @@ import (
 // AppID application name used for configuration file and default publisherID
 const AppID = "wallpaper"
 
+// Latency output instances with the time of each build step
+// The default latency output instance has the total build time.
+const (
+	LatencyInstanceDecode = "decode"
+	LatencyInstanceResize = "resize"
+	LatencyInstanceDraw   = "draw"
+	LatencyInstanceEncode = "encode"
+)
+
+// latencyBreakdownInstances holds the latency output instances of the build steps
+var latencyBreakdownInstances = []string{
+	LatencyInstanceDecode, LatencyInstanceResize, LatencyInstanceDraw, LatencyInstanceEncode,
+}
+
 // AppConfig with application configuration, loaded from wallpaper.yaml
 type AppConfig struct {
-	// PublisherID string                    `yaml:"publisherId"` // default publisher is app ID
-	Wallpapers []*MontageConfig `yaml:"wallpapers"` // collection of wallpapers
-	UseLibJPEG bool             `yaml:"useLibJPEG"` // Use the faster libjpeg library instead of the golang image library
+	PublisherID    string           `yaml:"publisherId,omitempty"`    // default publisher is app ID
+	Wallpapers     []*MontageConfig `yaml:"wallpapers"`               // collection of wallpapers
+	UseLibJPEG     bool             `yaml:"useLibJPEG"`               // Use the faster libjpeg library instead of the golang image library
+	MetricsAddress string           `yaml:"metricsAddress,omitempty"` // host:port of the metrics endpoint. Default is disabled
+	HTTPAddress    string           `yaml:"httpAddress,omitempty"`    // host:port of the server of wallpaper images. Default is disabled
 }
 
 // WallpaperApp publisher app
 type WallpaperApp struct {
-	config   *AppConfig // wallpaper application configuration
-	pub      *publisher.Publisher
-	montages map[string]*Montage // active wallpaper montages
+	config        *AppConfig // wallpaper application configuration
+	pub           *publisher.Publisher
+	montages      map[string]*Montage              // active wallpaper montages
+	montagesMutex sync.RWMutex                     // mutex for access to the montages
+	createMutex   sync.Mutex                       // mutex to serialize creating wallpapers
+	configMutex   sync.Mutex                       // mutex for changes to the application configuration
+	configFile    string                           // file to save the application configuration to, if any
+	configWatcher *fsnotify.Watcher                // watcher of the configuration file, nil if not watching
+	metrics       *WallpaperMetrics                // counters of building and publishing wallpaper images
+	metricsServer *http.Server                     // server of the metrics endpoint, nil if not serving
+	httpServer    *http.Server                     // server of the wallpaper images, nil if not serving
+	latestImages  map[string]*wallpaperImage       // latest image of each wallpaper, served over HTTP
+	imageStreams  map[string]map[*imageStream]bool // MJPEG stream clients of each wallpaper
+	imagesMutex   sync.RWMutex                     // mutex for access to the latest images and streams
+	eventStreams  map[*eventStream]bool            // event stream clients
+	eventsMutex   sync.Mutex                       // mutex for access to the event stream clients
+	outputHashes  map[string][sha1.Size]byte       // hash of the last image saved and published of each wallpaper
+	outputMutex   sync.Mutex                       // mutex for access to the output hashes
 }
 
 // CreateWallpaper creates wallpaper nodes, inputs and and montages from the given config
+// Returns nil if the configuration is invalid or a wallpaper with the ID already exists.
 func (app *WallpaperApp) CreateWallpaper(config *MontageConfig) *Montage {
 	pub := app.pub
 	logrus.Infof("CreateWallpaper %s", config.ID)
 	deviceID := config.ID
+	if err := config.Validate(); err != nil {
+		logrus.Errorf("CreateWallpaper: %s", err)
+		return nil
+	}
+	app.createMutex.Lock()
+	defer app.createMutex.Unlock()
+	if app.GetWallpaper(deviceID) != nil {
+		logrus.Errorf("CreateWallpaper: Wallpaper with ID '%s' already exists", deviceID)
+		return nil
+	}
 
 	pub.CreateNode(deviceID, types.NodeTypeWallpaper)
 	// pub.SetNodeAttr(wpid, types.NodeAttrMap{types.NodeAttrDescription: wpInfo.Address})
@@ -42,21 +90,21 @@ func (app *WallpaperApp) CreateWallpaper(config *MontageConfig) *Montage {
 		Description: "Thickness of the border between images in number of pixels",
 		Default:     "1",
 		Min:         0,
-		Max:         100,
+		Max:         MaxMontageBorder,
 	})
 	pub.UpdateNodeConfig(deviceID, "height", &types.ConfigAttr{
 		DataType:    types.DataTypeInt,
 		Description: "Height of the wallpaper image",
-		Default:     "1080",
-		Min:         16,
-		Max:         2160,
+		Default:     strconv.Itoa(DefaultMontageHeight),
+		Min:         MinMontageSize,
+		Max:         MaxMontageHeight,
 	})
 	pub.UpdateNodeConfig(deviceID, "width", &types.ConfigAttr{
 		DataType:    types.DataTypeInt,
 		Description: "Width of the wallpaper image",
-		Default:     "1920",
-		Min:         16,
-		Max:         4096,
+		Default:     strconv.Itoa(DefaultMontageWidth),
+		Min:         MinMontageSize,
+		Max:         MaxMontageWidth,
 	})
 	pub.UpdateNodeConfig(deviceID, "publish", &types.ConfigAttr{
 		DataType:    types.DataTypeBool,
@@ -67,48 +115,186 @@ func (app *WallpaperApp) CreateWallpaper(config *MontageConfig) *Montage {
 		DataType:    types.DataTypeEnum,
 		Description: "Resize the resulting composition to the given dimensions ",
 		Default:     "scale",
-		Enum:        []string{"scale", "crop", "none", "height", "width"},
+		Enum:        []string{"scale", "crop", "fit", "none", "height", "width"},
+	})
+	pub.UpdateNodeConfig(deviceID, "format", &types.ConfigAttr{
+		DataType:    types.DataTypeEnum,
+		Description: "Image format of the wallpaper",
+		Default:     string(MontageFormatJPEG),
+		Enum: []string{string(MontageFormatJPEG), string(MontageFormatPNG),
+			string(MontageFormatBMP), string(MontageFormatTIFF)},
+	})
+	pub.UpdateNodeConfig(deviceID, "quality", &types.ConfigAttr{
+		DataType:    types.DataTypeInt,
+		Description: "Quality of JPEG images",
+		Default:     strconv.Itoa(DefaultJPEGQuality),
+		Min:         1,
+		Max:         100,
 	})
 	pub.UpdateNodeConfig(deviceID, "rows", &types.ConfigAttr{
 		DataType:    types.DataTypeInt,
 		Description: "Number of rows to organize images in",
-		Default:     "1",
+		Default:     strconv.Itoa(DefaultMontageRows),
 		Min:         1,
-		Max:         5,
+		Max:         MaxMontageRows,
 	})
 	// the image and build time are both outputs
 	if config.Publish {
 		pub.CreateOutput(deviceID, types.OutputTypeImage, types.DefaultOutputInstance)
 	}
 	pub.CreateOutput(deviceID, types.OutputTypeLatency, types.DefaultOutputInstance)
+	for _, instance := range latencyBreakdownInstances {
+		pub.CreateOutput(deviceID, types.OutputTypeLatency, instance)
+	}
+	pub.CreateOutput(deviceID, OutputTypeSourceHealth, types.DefaultOutputInstance)
+	app.createRenditionOutputs(config)
+
+	app.createInputs(config)
+	app.publishImageConfig(config)
+	app.createImageCommandInputs(deviceID)
 
+	//
+	montage := NewMontage(config, app.config.UseLibJPEG)
+	app.montagesMutex.Lock()
+	app.montages[deviceID] = montage
+	app.montagesMutex.Unlock()
+	return montage
+}
+
+// createInputs creates the inputs for the image sources of the wallpaper
+// Each image placement is an input whose instance is the index of the placement.
+func (app *WallpaperApp) createInputs(config *MontageConfig) {
+	for index := range config.ProposedPlacements {
+		app.createInput(config.ID, index, &config.ProposedPlacements[index])
+	}
+}
+
+// createInput creates the input for the image source of a placement
+func (app *WallpaperApp) createInput(deviceID string, index int, placement *ImagePlacement) {
 	// Subscribe to source images...
 	// TODO: can we define inputs that link/subscribe to other outputs?
-	// TODO: configure inputs
-	for index, placement := range config.ProposedPlacements {
-		// each image is an input
-		// input := pub.NewInput(wpID, types.InputTypeImage, strconv.Itoa(index))
-		// input.Attr[types.NodeAttrAddress] = placement.Source
-		if strings.HasPrefix(placement.Source, "file://") {
-			app.pub.CreateInputFromFile(deviceID, types.InputTypeImage, strconv.Itoa(index),
-				placement.Source, app.HandleInputImage)
-			// app.fileWatcher.Add(placement.Source)
-		} else if strings.HasPrefix(placement.Source, "http://") {
-			login := ""
-			pass := ""
-			app.pub.CreateInputFromHTTP(deviceID, types.InputTypeImage, strconv.Itoa(index),
-				placement.Source, login, pass, placement.Interval, app.HandleInputImage)
-			logrus.Errorf("CreateWallpapersFromConfig: http source '%s' not yet supported: ", placement.Source)
-		} else {
-			app.pub.CreateInputFromOutput(deviceID, types.InputTypeImage, strconv.Itoa(index),
-				placement.Source, app.HandleInputImage)
-			// pub.messenger.Subscribe(placement.Source, HandleInputCommand)
+	// each image is an input
+	// input := pub.NewInput(wpID, types.InputTypeImage, strconv.Itoa(index))
+	// input.Attr[types.NodeAttrAddress] = placement.Source
+	if strings.HasPrefix(placement.Source, SourceSchemeFile) {
+		app.pub.CreateInputFromFile(deviceID, types.InputTypeImage, strconv.Itoa(index),
+			placement.Source, app.HandleInputImage)
+		// app.fileWatcher.Add(placement.Source)
+	} else if strings.HasPrefix(placement.Source, SourceSchemeHTTP) ||
+		strings.HasPrefix(placement.Source, SourceSchemeHTTPS) {
+		login := ""
+		pass := ""
+		app.pub.CreateInputFromHTTP(deviceID, types.InputTypeImage, strconv.Itoa(index),
+			placement.Source, login, pass, placement.Interval, app.HandleInputImage)
+	} else {
+		app.pub.CreateInputFromOutput(deviceID, types.InputTypeImage, strconv.Itoa(index),
+			placement.Source, app.HandleInputImage)
+		// pub.messenger.Subscribe(placement.Source, HandleInputCommand)
+	}
+}
+
+// deleteInputs deletes the inputs for the image sources of the wallpaper
+// This stops polling and unsubscribes from the image sources.
+func (app *WallpaperApp) deleteInputs(config *MontageConfig) {
+	for index := range config.ProposedPlacements {
+		app.deleteInput(config.ID, types.InputTypeImage, strconv.Itoa(index))
+	}
+}
+
+// inputDeleter is implemented by publishers that can delete an input of a node
+type inputDeleter interface {
+	DeleteInput(nodeHWID string, inputType types.InputType, instance string)
+}
+
+// outputDeleter is implemented by publishers that can delete an output of a node
+type outputDeleter interface {
+	DeleteOutput(nodeHWID string, outputType types.OutputType, instance string)
+}
+
+// deleteInput deletes an input of a node if the publisher supports deleting inputs
+func (app *WallpaperApp) deleteInput(nodeHWID string, inputType types.InputType, instance string) {
+	deleter, ok := interface{}(app.pub).(inputDeleter)
+	if !ok {
+		logrus.Warningf("deleteInput: Publisher can't delete input %s/%s/%s", nodeHWID, inputType, instance)
+		return
+	}
+	deleter.DeleteInput(nodeHWID, inputType, instance)
+}
+
+// deleteOutput deletes an output of a node if the publisher supports deleting outputs
+func (app *WallpaperApp) deleteOutput(nodeHWID string, outputType types.OutputType, instance string) {
+	deleter, ok := interface{}(app.pub).(outputDeleter)
+	if !ok {
+		logrus.Warningf("deleteOutput: Publisher can't delete output %s/%s/%s", nodeHWID, outputType, instance)
+		return
+	}
+	deleter.DeleteOutput(nodeHWID, outputType, instance)
+}
+
+// updateInputs rewires the inputs whose image source or poll interval has changed
+func (app *WallpaperApp) updateInputs(oldConfig *MontageConfig, newConfig *MontageConfig) {
+	oldPlacements := oldConfig.ProposedPlacements
+	newPlacements := newConfig.ProposedPlacements
+	for index := 0; index < len(oldPlacements) || index < len(newPlacements); index++ {
+		if index < len(oldPlacements) && index < len(newPlacements) &&
+			oldPlacements[index].Source == newPlacements[index].Source &&
+			oldPlacements[index].Interval == newPlacements[index].Interval {
+			continue
+		}
+		if index < len(oldPlacements) {
+			app.deleteInput(oldConfig.ID, types.InputTypeImage, strconv.Itoa(index))
+		}
+		if index < len(newPlacements) {
+			logrus.Infof("updateInputs: Input %d of wallpaper %s uses source '%s'",
+				index, newConfig.ID, newPlacements[index].Source)
+			app.createInput(newConfig.ID, index, &newPlacements[index])
 		}
 	}
+}
 
-	//
-	montage := NewMontage(config, app.config.UseLibJPEG)
-	app.montages[deviceID] = montage
+// UpdateWallpaper applies a changed configuration to an existing wallpaper
+// The inputs are rewired when their image source has changed. The latest images of sources that
+// remain in use are kept. Returns nil if the wallpaper doesn't exist or the configuration is invalid.
+func (app *WallpaperApp) UpdateWallpaper(config *MontageConfig) *Montage {
+	logrus.Infof("UpdateWallpaper %s", config.ID)
+	montage := app.GetWallpaper(config.ID)
+	if montage == nil {
+		logrus.Errorf("UpdateWallpaper: No wallpaper with ID %s", config.ID)
+		return nil
+	}
+	montage.changeMutex.Lock()
+	defer montage.changeMutex.Unlock()
+	return app.updateWallpaper(montage, config)
+}
+
+// updateWallpaper applies a changed configuration to the montage of an existing wallpaper
+// The caller must hold the changeMutex of the montage. Returns nil if the configuration is invalid.
+func (app *WallpaperApp) updateWallpaper(montage *Montage, config *MontageConfig) *Montage {
+	if err := config.Validate(); err != nil {
+		logrus.Errorf("UpdateWallpaper: %s", err)
+		return nil
+	}
+	oldConfig := montage.getConfig()
+	app.updateInputs(&oldConfig, config)
+	if !reflect.DeepEqual(oldConfig.ProposedPlacements, config.ProposedPlacements) {
+		app.publishImageConfig(config)
+	}
+	if len(config.ProposedPlacements) < len(oldConfig.ProposedPlacements) {
+		app.clearImageConfig(config.ID, len(config.ProposedPlacements), len(oldConfig.ProposedPlacements))
+		app.clearSourceStatus(config.ID, len(config.ProposedPlacements), len(oldConfig.ProposedPlacements))
+	}
+	if config.Publish && !oldConfig.Publish {
+		app.pub.CreateOutput(config.ID, types.OutputTypeImage, types.DefaultOutputInstance)
+	} else if !config.Publish && oldConfig.Publish {
+		app.deleteOutput(config.ID, types.OutputTypeImage, types.DefaultOutputInstance)
+	}
+	if !reflect.DeepEqual(oldConfig.Renditions, config.Renditions) {
+		app.deleteRenditionOutputs(&oldConfig)
+		app.createRenditionOutputs(config)
+	}
+	// the image is saved and published with the new configuration even if it is unchanged
+	app.forgetOutputHash(config.ID)
+	montage.Reconfigure(config)
 	return montage
 }
 
@@ -124,61 +310,215 @@ func (app *WallpaperApp) CreateWallpapersFromAppConfig(config *AppConfig) {
 }
 
 // CheckUpdateWallpapers checks each montage image if it has been updated and a
-// new image should be generated.
+// new image should be generated. Updates are coalesced using the montage WaitTime.
 func (app *WallpaperApp) CheckUpdateWallpapers(pub *publisher.Publisher) {
-
+	now := time.Now()
+	app.montagesMutex.RLock()
+	montages := make([]*Montage, 0, len(app.montages))
 	for _, montage := range app.montages {
-		if montage.UpdateCount > 0 {
+		montages = append(montages, montage)
+	}
+	app.montagesMutex.RUnlock()
+
+	for _, montage := range montages {
+		montage.UpdateStaleImages(now)
+		app.publishHealthChanges(montage)
+		if montage.IsRebuildDue(now) {
 			app.GenerateWallpaperImage(montage)
 		}
 	}
 }
 
-// DeleteWallpaper deletes a wallpaper
+// DeleteWallpaper deletes a wallpaper including its node, inputs and outputs, and releases its montage
 func (app *WallpaperApp) DeleteWallpaper(ID string) {
-	app.montages[ID] = nil
+	logrus.Infof("DeleteWallpaper %s", ID)
+	app.montagesMutex.Lock()
+	montage := app.montages[ID]
+	delete(app.montages, ID)
+	app.montagesMutex.Unlock()
+	if montage == nil {
+		logrus.Warningf("DeleteWallpaper: No wallpaper with ID %s", ID)
+		return
+	}
+	montage.changeMutex.Lock()
+	defer montage.changeMutex.Unlock()
+	config := montage.getConfig()
+	app.deleteInputs(&config)
+	app.deleteImageCommandInputs(ID)
+	if config.Publish {
+		app.deleteOutput(ID, types.OutputTypeImage, types.DefaultOutputInstance)
+	}
+	app.deleteOutput(ID, types.OutputTypeLatency, types.DefaultOutputInstance)
+	for _, instance := range latencyBreakdownInstances {
+		app.deleteOutput(ID, types.OutputTypeLatency, instance)
+	}
+	app.deleteOutput(ID, OutputTypeSourceHealth, types.DefaultOutputInstance)
+	app.deleteRenditionOutputs(&config)
+	app.pub.DeleteNode(ID)
+	app.metrics.deleteWallpaper(ID)
+	app.deleteLatestImage(ID)
+	app.forgetOutputHash(ID)
+	montage.Release()
 }
 
 // GetWallpaper returns a wallpaper montage instance by its ID
 func (app *WallpaperApp) GetWallpaper(ID string) *Montage {
+	app.montagesMutex.RLock()
+	defer app.montagesMutex.RUnlock()
 	montage := app.montages[ID]
 	return montage
 }
 
-// GenerateWallpaperImage generates a new wallpaper image.
-// Depending on the configuration, the image is saved and/or published
+// GenerateWallpaperImage generates a new wallpaper image and resets the montage update count.
+// Depending on the configuration, the image and its renditions are saved and/or published.
+// The build latency is published on the latency outputs and the source health as node status.
+// Event stream clients are notified of the new image.
 func (app *WallpaperApp) GenerateWallpaperImage(montage *Montage) {
-	jpegData, err := montage.ExportMontageAsJPEG()
+	config := montage.getConfig()
+	montage.ResetUpdateCount()
+	// changes after this point are part of the next image
+	generation, changedPlacements := montage.TakeChanges()
+	imageData, renditionData, err := montage.ExportMontageWithRenditions()
 	if err != nil {
-		// app.logger.Errorf("Updatewallpaper: Error generating montage image for %s: %s", montage.Config.ID, err)
+		// app.logger.Errorf("Updatewallpaper: Error generating montage image for %s: %s", config.ID, err)
+		montage.RestoreChanges(changedPlacements)
 		return
 	}
-	filename := montage.Config.Filename
-	if filename != "" {
-		err = ioutil.WriteFile(filename, jpegData, os.ModePerm)
+	timings := montage.TakeBuildTimings()
+	outputBytes := len(imageData)
+	for _, data := range renditionData {
+		outputBytes += len(data)
+	}
+	app.metrics.recordBuild(config.ID, timings.Encode, outputBytes)
+	app.publishLatency(config.ID, timings)
+	app.publishSourceStatus(montage)
+	imageHash := sha1.Sum(imageData)
+	if !app.isOutputChanged(config.ID, imageHash) {
+		logrus.Debugf("GenerateWallpaperImage: Image of wallpaper %s is unchanged", config.ID)
+		montage.RestoreChanges(changedPlacements)
+		return
+	}
+	app.storeLatestImage(config.ID, imageData, config.Format.ContentType())
+	err = app.saveWallpaperImage(&config, imageData)
+	if config.Publish {
+		output := app.pub.GetOutputByNodeHWID(config.ID, types.OutputTypeImage, types.DefaultOutputInstance)
+		app.pub.PublishRaw(output, false, string(imageData))
+	}
+	if renditionErr := app.publishRenditions(&config, renditionData); err == nil {
+		err = renditionErr
+	}
+	// a failed save is retried with the next image even if it is unchanged
+	if err == nil {
+		app.storeOutputHash(config.ID, imageHash)
+	}
+	app.publishEvent(&WallpaperEvent{ID: config.ID, Generation: generation,
+		Timestamp: time.Now(), ChangedPlacements: changedPlacements})
+}
+
+// isOutputChanged returns true if the image hash differs from the last image saved and published
+func (app *WallpaperApp) isOutputChanged(wallpaperID string, imageHash [sha1.Size]byte) bool {
+	app.outputMutex.Lock()
+	defer app.outputMutex.Unlock()
+	lastHash, found := app.outputHashes[wallpaperID]
+	return !found || lastHash != imageHash
+}
+
+// storeOutputHash keeps the hash of the image that was saved and published to compare the next image with
+func (app *WallpaperApp) storeOutputHash(wallpaperID string, imageHash [sha1.Size]byte) {
+	app.outputMutex.Lock()
+	defer app.outputMutex.Unlock()
+	app.outputHashes[wallpaperID] = imageHash
+}
+
+// forgetOutputHash forgets the hash of the last image of a wallpaper, so the next image is
+// saved and published even if it is unchanged.
+func (app *WallpaperApp) forgetOutputHash(wallpaperID string) {
+	app.outputMutex.Lock()
+	defer app.outputMutex.Unlock()
+	delete(app.outputHashes, wallpaperID)
+}
+
+// createRenditionOutputs creates the image outputs of the renditions that are published
+// The output instance is the rendition name.
+func (app *WallpaperApp) createRenditionOutputs(config *MontageConfig) {
+	for _, rendition := range config.Renditions {
+		if rendition.Publish {
+			app.pub.CreateOutput(config.ID, types.OutputTypeImage, rendition.Name)
+		}
+	}
+}
+
+// deleteRenditionOutputs deletes the image outputs of the renditions that are published
+func (app *WallpaperApp) deleteRenditionOutputs(config *MontageConfig) {
+	for _, rendition := range config.Renditions {
+		if rendition.Publish {
+			app.deleteOutput(config.ID, types.OutputTypeImage, rendition.Name)
+		}
 	}
-	if montage.Config.Publish {
-		output := app.pub.GetOutputByNodeHWID(montage.Config.ID, types.OutputTypeImage, types.DefaultOutputInstance)
-		app.pub.PublishRaw(output, false, string(jpegData))
+}
+
+// publishRenditions saves and publishes the image of each rendition, depending on its configuration
+// Returns the first error saving a rendition image.
+func (app *WallpaperApp) publishRenditions(config *MontageConfig, renditionData [][]byte) error {
+	var err error
+	for index, data := range renditionData {
+		if index >= len(config.Renditions) {
+			break
+		}
+		rendition := &config.Renditions[index]
+		if saveErr := app.saveRenditionImage(config, rendition, data); err == nil {
+			err = saveErr
+		}
+		if rendition.Publish {
+			output := app.pub.GetOutputByNodeHWID(config.ID, types.OutputTypeImage, rendition.Name)
+			app.pub.PublishRaw(output, false, string(data))
+		}
 	}
+	return err
+}
 
+// publishLatency publishes the total build time and the time of each build step in seconds
+func (app *WallpaperApp) publishLatency(deviceID string, timings BuildTimings) {
+	logrus.Debugf("publishLatency: Wallpaper %s built in %s (%+v)", deviceID, timings.Total(), timings)
+	values := map[string]time.Duration{
+		types.DefaultOutputInstance: timings.Total(),
+		LatencyInstanceDecode:       timings.Decode,
+		LatencyInstanceResize:       timings.Resize,
+		LatencyInstanceDraw:         timings.Draw,
+		LatencyInstanceEncode:       timings.Encode,
+	}
+	for instance, duration := range values {
+		app.pub.UpdateOutputValue(deviceID, types.OutputTypeLatency, instance,
+			strconv.FormatFloat(duration.Seconds(), 'f', 3, 64))
+	}
 }
 
 // HandleInputImage updates the wallpaper image
 func (app *WallpaperApp) HandleInputImage(input *types.InputDiscoveryMessage, sender string, image string) {
 	logrus.Infof("HandleInputUpdate: Update to input %s from '%s'", input.InputID, sender)
 	montage := app.GetWallpaper(input.NodeHWID)
+	if montage == nil {
+		logrus.Warningf("HandleInputUpdate: No wallpaper with ID %s", input.NodeHWID)
+		return
+	}
 	montage.UpdateImage(input.Source, []byte(image))
 }
 
 // NewWallpaperApp creates the wallpapers from config
 func NewWallpaperApp(config *AppConfig, pub *publisher.Publisher) *WallpaperApp {
 	app := WallpaperApp{
-		config:   config,
-		pub:      pub,
-		montages: make(map[string]*Montage),
+		config:       config,
+		pub:          pub,
+		montages:     make(map[string]*Montage),
+		metrics:      NewWallpaperMetrics(),
+		latestImages: make(map[string]*wallpaperImage),
+		imageStreams: make(map[string]map[*imageStream]bool),
+		eventStreams: make(map[*eventStream]bool),
+		outputHashes: make(map[string][sha1.Size]byte),
 	}
 	app.CreateWallpapersFromAppConfig(config)
+	// Support remote creation and deletion of wallpapers
+	app.createManagerNode()
 
 	// Each second check if a new wallpaper image needs to be generated after update
 	pub.SetPollInterval(1, app.CheckUpdateWallpapers)
@@ -191,11 +531,36 @@ func NewWallpaperApp(config *AppConfig, pub *publisher.Publisher) *WallpaperApp
 func Run() {
 	appConfig := &AppConfig{}
 	appConfig.Wallpapers = make([]*MontageConfig, 0)
-	pub, _ := publisher.NewAppPublisher(AppID, "", appConfig, "", true)
+	configFolder := DefaultConfigFolder()
+	pub, _ := publisher.NewAppPublisher(AppID, configFolder, appConfig, "", true)
 
-	NewWallpaperApp(appConfig, pub)
+	// reload the application configuration with strict checking, aliases and defaults
+	appConfig.Wallpapers = make([]*MontageConfig, 0)
+	err := LoadAppConfig(path.Join(configFolder, AppID+".yaml"), appConfig)
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Errorf("Run: Not starting due to invalid configuration: %s", err)
+		return
+	}
+
+	app := NewWallpaperApp(appConfig, pub)
+	app.configFile = path.Join(configFolder, AppID+".yaml")
+	err = app.WatchConfigFile(app.configFile)
+	if err != nil {
+		logrus.Warningf("Run: Configuration changes require a restart: %s", err)
+	}
+
+	if appConfig.HTTPAddress != "" {
+		app.StartHTTPServer(appConfig.HTTPAddress)
+	}
+	// the HTTP server of the wallpaper images also serves the metrics
+	if appConfig.MetricsAddress != "" && appConfig.MetricsAddress != appConfig.HTTPAddress {
+		app.StartMetricsServer(appConfig.MetricsAddress)
+	}
 
 	pub.Start()
 	pub.WaitForSignal()
+	app.StopMetricsServer()
+	app.StopHTTPServer()
+	app.StopWatchingConfigFile()
 	pub.Stop()
 }
@@ -1,19 +1,40 @@
 package internal
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/iotdomain/iotdomain-go/publisher"
+	"github.com/iotdomain/iotdomain-go/types"
 	"github.com/stretchr/testify/assert"
 )
 
 const cacheFolder = "../test/cache"
 const configFolder = "../test"
 
-const TestMontageFile = "../test/montage.jpeg"
+// testFolder is the temporary folder the tests write images to
+var testFolder, _ = ioutil.TempDir("", "wallpaper")
+
+// TestMontageFile is the montage image written by the tests
+var TestMontageFile = filepath.Join(testFolder, "montage.jpeg")
 
 var appConfig *AppConfig = &AppConfig{}
 
@@ -67,6 +88,27 @@ var config2 = &MontageConfig{
 	},
 }
 
+// TestMain removes the images written by the tests
+func TestMain(m *testing.M) {
+	code := m.Run()
+	os.RemoveAll(testFolder)
+	os.Exit(code)
+}
+
+// newTestWallpaper creates an app with a wallpaper from a copy of config2
+// The configuration is changed with setup, if given, before the wallpaper is created.
+func newTestWallpaper(t *testing.T, setup func(config *MontageConfig)) (*WallpaperApp, *MontageConfig, *Montage) {
+	pub, _ := publisher.NewAppPublisher(AppID, configFolder, appConfig, "", false)
+	app := NewWallpaperApp(appConfig, pub)
+	config := *config2
+	if setup != nil {
+		setup(&config)
+	}
+	montage := app.CreateWallpaper(&config)
+	assert.NotNil(t, montage)
+	return app, &config, montage
+}
+
 // Create a montage and layout 2 images onto its canvas
 func TestMontageLayout(t *testing.T) {
 	os.Remove(TestMontageFile)
@@ -77,6 +119,9 @@ func TestMontageLayout(t *testing.T) {
 
 	assert.Len(t, montage.actualPlacement, 2, "Expected 2 image placements for this montage")
 	assert.Equal(t, 1680, montage.canvas.Rect.Max.X)
+	// the y-offset of the first image is clipped to its grid cell
+	assert.Equal(t, 31, montage.actualPlacement[0].Y)
+	assert.Equal(t, 1080-31-1, montage.actualPlacement[0].Height)
 
 	image, _ := ioutil.ReadFile("../test/camera-sshed.jpeg")
 	montage.UpdateImage("test/ipcam/snowshed/image/0", image)
@@ -103,6 +148,14 @@ func TestImageUpdate(t *testing.T) {
 
 	assert.Equal(t, 4, montage.UpdateCount, "4 Updates expected")
 
+	// a frame that fails to decode doesn't replace the latest image of the source
+	montage.UpdateImage("test/ipcam/cam7/image/0", []byte("not an image"))
+	cached, _ := montage.GetSourceImage(3)
+	assert.Equal(t, image, cached, "Latest good image is kept")
+	montage.Reconfigure(config2)
+	cached, _ = montage.GetSourceImage(3)
+	assert.Equal(t, image, cached, "Latest good image is redrawn after a rebuild")
+
 	_ = os.Remove(TestMontageFile)
 	err := montage.WriteToFile(TestMontageFile)
 	assert.NoError(t, err)
@@ -121,12 +174,20 @@ func BenchmarkWallpaper(b *testing.B) {
 	//image4, _ := ioutil.ReadFile("test/camera-cam7.jpeg")
 	image4, _ := ioutil.ReadFile("../test/circles.png")
 
+	images := [][]byte{image1, image2, image3, image4}
+	sources := []string{
+		"test/ipcam/snowshed/image/0",
+		"test/ipcam/kelowna1/image/0",
+		"test/ipcam/cam6/image/0",
+		"test/ipcam/cam7/image/0",
+	}
+
 	t1 := time.Now()
 	for i := 0; i < 25; i++ {
-		montage.UpdateImage("test/ipcam/snowshed/image/0", image1)
-		montage.UpdateImage("test/ipcam/kelowna1/image/0", image2)
-		montage.UpdateImage("test/ipcam/cam6/image/0", image3)
-		montage.UpdateImage("test/ipcam/cam7/image/0", image4)
+		// each update has a different image as identical images are not redrawn
+		for index, source := range sources {
+			montage.UpdateImage(source, images[(index+i)%len(images)])
+		}
 		data, err := montage.ExportMontageAsJPEG()
 		assert.NoError(b, err)
 		assert.NotNil(b, data)
@@ -140,3 +201,967 @@ func BenchmarkWallpaper(b *testing.B) {
 
 	assert.Equal(b, 100, montage.UpdateCount, "Updates expected")
 }
+
+// Change the montage configuration remotely and check the canvas is rebuilt
+func TestRemoteConfig(t *testing.T) {
+	pub, _ := publisher.NewAppPublisher(AppID, configFolder, appConfig, "", false)
+	app := NewWallpaperApp(appConfig, pub)
+	montage := app.CreateWallpaper(config2)
+
+	image, _ := ioutil.ReadFile("../test/camera-sshed.jpeg")
+	montage.UpdateImage("test/ipcam/snowshed/image/0", image)
+
+	app.HandleConfigCommand(config2.ID, types.NodeAttrMap{"width": "800", "height": "600", "rows": "1"})
+	assert.Equal(t, 800, montage.canvas.Rect.Max.X)
+	assert.Equal(t, 600, montage.canvas.Rect.Max.Y)
+	assert.Equal(t, 1, montage.Config.Rows)
+	assert.Len(t, montage.actualPlacement, 4)
+	assert.Equal(t, 600-2*config2.Border, montage.actualPlacement[0].Height)
+	assert.Equal(t, 3, montage.UpdateCount, "Canvas rebuild and cached image redraw expected")
+
+	// invalid values are ignored
+	app.HandleConfigCommand(config2.ID, types.NodeAttrMap{"width": "wide"})
+	assert.Equal(t, 800, montage.Config.Width)
+}
+
+// Updates are coalesced within WaitTime and forced after MaxWaitTime
+func TestRebuildSchedule(t *testing.T) {
+	pub, _ := publisher.NewAppPublisher(AppID, configFolder, appConfig, "", false)
+	app := NewWallpaperApp(appConfig, pub)
+	config := *config2
+	config.WaitTime = 2
+	config.MaxWaitTime = 5
+	montage := app.CreateWallpaper(&config)
+	assert.False(t, montage.IsRebuildDue(time.Now()), "No rebuild without updates")
+
+	image, _ := ioutil.ReadFile("../test/camera-sshed.jpeg")
+	montage.UpdateImage("test/ipcam/snowshed/image/0", image)
+	start := montage.firstUpdate
+	assert.False(t, montage.IsRebuildDue(start.Add(time.Second)))
+	assert.True(t, montage.IsRebuildDue(start.Add(2*time.Second)))
+
+	// continuous updates postpone the rebuild until MaxWaitTime
+	montage.lastUpdate = start.Add(4 * time.Second)
+	assert.False(t, montage.IsRebuildDue(start.Add(4*time.Second)))
+	assert.True(t, montage.IsRebuildDue(start.Add(5*time.Second)))
+
+	app.GenerateWallpaperImage(montage)
+	assert.Equal(t, 0, montage.UpdateCount)
+	assert.False(t, montage.IsRebuildDue(start.Add(10*time.Second)))
+}
+
+// Update images and export the montage concurrently. Run with -race to detect data races.
+func TestConcurrentUpdate(t *testing.T) {
+	pub, _ := publisher.NewAppPublisher(AppID, configFolder, appConfig, "", false)
+	app := NewWallpaperApp(appConfig, pub)
+	montage := app.CreateWallpaper(config2)
+
+	image1, _ := ioutil.ReadFile("../test/camera-sshed.jpeg")
+	image2, _ := ioutil.ReadFile("../test/camera-zkioskn.jpeg")
+	image3, _ := ioutil.ReadFile("../test/camera-cam6.jpeg")
+	image4, _ := ioutil.ReadFile("../test/camera-cam7.jpeg")
+	images := [][]byte{image1, image2, image3, image4}
+	sources := []string{
+		"test/ipcam/snowshed/image/0",
+		"test/ipcam/kelowna1/image/0",
+		"test/ipcam/cam6/image/0",
+		"test/ipcam/cam7/image/0",
+	}
+	const rounds = 5
+	wg := sync.WaitGroup{}
+	for index, source := range sources {
+		wg.Add(1)
+		// each update has a different image as identical images are not redrawn
+		go func(index int, source string) {
+			for i := 0; i < rounds; i++ {
+				montage.UpdateImage(source, images[(index+i)%len(images)])
+			}
+			wg.Done()
+		}(index, source)
+	}
+	wg.Add(1)
+	go func() {
+		for i := 0; i < rounds; i++ {
+			data, err := montage.ExportMontageAsJPEG()
+			assert.NoError(t, err)
+			assert.NotEmpty(t, data)
+			montage.IsRebuildDue(time.Now())
+		}
+		wg.Done()
+	}()
+	// the configuration changes while images are drawn and exported
+	wg.Add(1)
+	go func() {
+		for i := 0; i < rounds; i++ {
+			app.HandleConfigCommand(config2.ID, types.NodeAttrMap{"border": strconv.Itoa(i)})
+			app.GenerateWallpaperImage(montage)
+		}
+		wg.Done()
+	}()
+	wg.Wait()
+	assert.Equal(t, rounds-1, montage.getConfig().Border)
+	health := montage.GetSourceHealth()
+	for _, source := range sources {
+		assert.Equal(t, rounds, health[source].FramesReceived)
+	}
+}
+
+// Images drawn into a layout that has since been rebuilt are dropped
+func TestStaleLayoutDraw(t *testing.T) {
+	_, config, montage := newTestWallpaper(t, nil)
+	montage.updateMutex.Lock()
+	placement := montage.actualPlacement[0]
+	layoutVersion := montage.layoutVersion
+	montage.updateMutex.Unlock()
+
+	changed := *config
+	changed.Border = config.Border + 10
+	montage.Reconfigure(&changed)
+	canvas := append([]uint8{}, montage.canvas.Pix...)
+	image, _ := ioutil.ReadFile("../test/camera-sshed.jpeg")
+	err := montage.drawPlacement(&placement, image, layoutVersion)
+	assert.Equal(t, errLayoutChanged, err)
+	montage.drawTile(montage.makeMissingTile(placement.Width, placement.Height), &placement, layoutVersion)
+	assert.Equal(t, canvas, montage.canvas.Pix, "Old placements are not drawn on the new canvas")
+
+	// updates are drawn in the new layout
+	assert.True(t, montage.drawSource(placement.Source, image))
+	assert.NotEqual(t, canvas, montage.canvas.Pix)
+}
+
+// Sources without a recent image show the missing image
+func TestMissingImage(t *testing.T) {
+	pub, _ := publisher.NewAppPublisher(AppID, configFolder, appConfig, "", false)
+	app := NewWallpaperApp(appConfig, pub)
+	config := *config2
+	config.MaxAge = 60
+	montage := app.CreateWallpaper(&config)
+	assert.Len(t, montage.staleSources, 4, "Sources that never reported are missing")
+	placement := montage.actualPlacement[0]
+	assert.NotEqual(t, uint8(0), montage.canvas.RGBAAt(placement.X+1, placement.Y+1).R)
+
+	image, _ := ioutil.ReadFile("../test/camera-sshed.jpeg")
+	montage.UpdateImage(placement.Source, image)
+	assert.Len(t, montage.staleSources, 3)
+	assert.Equal(t, 1, montage.UpdateCount)
+
+	montage.UpdateStaleImages(time.Now())
+	assert.Equal(t, 1, montage.UpdateCount, "Already missing images are not redrawn")
+
+	montage.UpdateStaleImages(time.Now().Add(61 * time.Second))
+	assert.True(t, montage.staleSources[placement.Source], "Old image should be stale")
+	assert.Equal(t, 2, montage.UpdateCount)
+}
+
+// Fit images preserving aspect ratio and fill the remainder with the background
+func TestFitImage(t *testing.T) {
+	pub, _ := publisher.NewAppPublisher(AppID, configFolder, appConfig, "", false)
+	app := NewWallpaperApp(appConfig, pub)
+	config := *config2
+	config.Rows = 1
+	config.Width = 1000
+	config.Height = 200
+	config.Resize = MontageResizeFit
+	config.Background = "#ff0000"
+	config.ProposedPlacements = []ImagePlacement{
+		{Source: "test/ipcam/snowshed/image/0"},
+		{Source: "test/ipcam/kelowna1/image/0", Align: MontageAlignLeft},
+	}
+	montage := app.CreateWallpaper(&config)
+
+	image, _ := ioutil.ReadFile("../test/camera-sshed.jpeg")
+	montage.UpdateImage("test/ipcam/snowshed/image/0", image)
+	montage.UpdateImage("test/ipcam/kelowna1/image/0", image)
+	red := color.RGBA{R: 255, A: 255}
+	p1 := montage.actualPlacement[0]
+	p2 := montage.actualPlacement[1]
+	// centered images are letterboxed on both sides, left aligned images only on the right
+	assert.Equal(t, red, montage.canvas.RGBAAt(p1.X, p1.Y+p1.Height/2))
+	assert.Equal(t, red, montage.canvas.RGBAAt(p1.X+p1.Width-1, p1.Y+p1.Height/2))
+	assert.NotEqual(t, red, montage.canvas.RGBAAt(p2.X, p2.Y+p2.Height/2))
+	assert.Equal(t, red, montage.canvas.RGBAAt(p2.X+p2.Width-1, p2.Y+p2.Height/2))
+}
+
+// Place images at absolute positions with a picture-in-picture
+func TestFreeLayout(t *testing.T) {
+	config := MontageConfig{
+		ID:     "free",
+		Width:  1000,
+		Height: 500,
+		Layout: MontageLayoutFree,
+		ProposedPlacements: []ImagePlacement{
+			{Source: "main"},
+			{Source: "pip", X: 75, Y: 70, Width: 25, Height: 30, Unit: "%"},
+		},
+	}
+	placements, err := MakeFreeLayout(&config)
+	assert.NoError(t, err)
+	assert.Len(t, placements, 2)
+	assert.Equal(t, ImagePlacement{Source: "main", Width: 1000, Height: 500}, placements[0])
+	assert.Equal(t, ImagePlacement{Source: "pip", X: 750, Y: 350, Width: 250, Height: 150}, placements[1])
+
+	// updating the main image keeps the picture-in-picture on top
+	montage := NewMontage(&config, false)
+	image1, _ := ioutil.ReadFile("../test/camera-sshed.jpeg")
+	image2, _ := ioutil.ReadFile("../test/circles.png")
+	montage.UpdateImage("pip", image2)
+	pip := montage.canvas.RGBAAt(800, 400)
+	montage.UpdateImage("main", image1)
+	assert.Equal(t, pip, montage.canvas.RGBAAt(800, 400))
+
+	// the missing image of a stale main image also keeps the picture-in-picture on top
+	montage.Config.MaxAge = 60
+	montage.sourceUpdated["pip"] = time.Now().Add(time.Hour)
+	montage.UpdateStaleImages(time.Now().Add(61 * time.Second))
+	assert.True(t, montage.staleSources["main"])
+	assert.Equal(t, pip, montage.canvas.RGBAAt(800, 400))
+	montage = NewMontage(&config, false)
+	montage.UpdateImage("pip", image2)
+	montage.Reconfigure(&config)
+	assert.Equal(t, pip, montage.canvas.RGBAAt(800, 400), "Main never reported")
+
+	config.ProposedPlacements[1].X = 90
+	placements, err = MakeFreeLayout(&config)
+	assert.Error(t, err)
+	assert.Equal(t, 100, placements[1].Width, "Placement should be clipped to the canvas")
+}
+
+// Justified layout adapts to the aspect ratio of the images
+func TestJustifiedLayout(t *testing.T) {
+	config := MontageConfig{
+		ID:     "justified",
+		Width:  1600,
+		Height: 900,
+		Layout: MontageLayoutJustified,
+		ProposedPlacements: []ImagePlacement{
+			{Source: "wide"}, {Source: "portrait"}, {Source: "square"},
+		},
+	}
+	sizes := map[string]image.Point{
+		"wide":     image.Pt(1600, 900),
+		"portrait": image.Pt(900, 1600),
+		"square":   image.Pt(800, 800),
+	}
+	placements := MakeJustifiedLayout(&config, sizes)
+	assert.Len(t, placements, 3)
+	// single row of equal height images with their native aspect ratio
+	for _, placement := range placements {
+		assert.Equal(t, placements[0].Height, placement.Height)
+		assert.True(t, placement.X+placement.Width <= config.Width)
+		assert.True(t, placement.Y+placement.Height <= config.Height)
+	}
+	assert.InDelta(t, 1.0, float64(placements[2].Width)/float64(placements[2].Height), 0.02)
+
+	// first image triggers a new layout
+	montage := NewMontage(&config, false)
+	payload, _ := ioutil.ReadFile("../test/camera-sshed.jpeg")
+	montage.UpdateImage("wide", payload)
+	assert.Len(t, montage.sourceSizes, 1)
+	assert.False(t, montage.staleSources["wide"])
+}
+
+// Layout templates place the primary image in the large slot
+func TestTemplateLayout(t *testing.T) {
+	config := MontageConfig{
+		ID:     "template",
+		Width:  1200,
+		Height: 900,
+		Border: 2,
+		Layout: MontageLayout1Plus5,
+		ProposedPlacements: []ImagePlacement{
+			{Source: "cam1"}, {Source: "cam2"}, {Source: "cam3", Primary: true},
+			{Source: "cam4"}, {Source: "cam5"}, {Source: "cam6"},
+		},
+	}
+	placements := MakeLayout(&config, nil)
+	assert.Len(t, placements, 6)
+	assert.Equal(t, "cam3", placements[0].Source)
+	assert.Equal(t, "cam1", placements[1].Source)
+	assert.Equal(t, image.Rect(2, 2, 799, 599), image.Rect(placements[0].X, placements[0].Y,
+		placements[0].X+placements[0].Width, placements[0].Y+placements[0].Height))
+	last := placements[5]
+	assert.Equal(t, config.Width-config.Border, last.X+last.Width)
+	assert.Equal(t, config.Height-config.Border, last.Y+last.Height)
+
+	pub, _ := publisher.NewAppPublisher(AppID, configFolder, appConfig, "", false)
+	app := NewWallpaperApp(appConfig, pub)
+	assert.NotNil(t, app.CreateWallpaper(&config))
+	// wallpapers with more images than template slots or with several primary images are rejected
+	overflow := config
+	overflow.ProposedPlacements = append(config.ProposedPlacements[:6:6], ImagePlacement{Source: "cam7"})
+	assert.Nil(t, app.CreateWallpaper(&overflow), "Images exceeding the template slots are rejected")
+	primaries := config
+	primaries.ProposedPlacements = []ImagePlacement{{Source: "cam1", Primary: true}, {Source: "cam2", Primary: true}}
+	err := primaries.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "primary")
+	}
+	assert.Nil(t, app.CreateWallpaper(&primaries))
+
+	config = overflow
+	config.ID = "strip"
+	config.Layout = MontageLayoutSideStrip
+	placements = MakeLayout(&config, nil)
+	assert.Len(t, placements, 7)
+	assert.NotNil(t, app.CreateWallpaper(&config), "The side strip holds all images")
+	assert.InDelta(t, placements[1].Height, placements[6].Height, 1)
+	assert.Equal(t, placements[0].Height+2*config.Border, config.Height)
+}
+
+// Images spanning multiple cells in a weighted grid
+func TestSpanGridLayout(t *testing.T) {
+	config := MontageConfig{
+		ID:         "spans",
+		Width:      1200,
+		Height:     900,
+		Rows:       2,
+		RowWeights: []float64{2, 1},
+		ProposedPlacements: []ImagePlacement{
+			{Source: "panorama", ColSpan: 2}, {Source: "cam2"},
+			{Source: "cam3"}, {Source: "cam4"}, {Source: "cam5"},
+		},
+	}
+	placements := MakeGridLayout(&config)
+	assert.Len(t, placements, 5)
+	assert.Equal(t, ImagePlacement{Source: "panorama", Width: 800, Height: 600}, placements[0])
+	assert.Equal(t, ImagePlacement{Source: "cam2", X: 800, Width: 400, Height: 600}, placements[1])
+	assert.Equal(t, ImagePlacement{Source: "cam3", Y: 600, Width: 400, Height: 300}, placements[2])
+
+	// images that don't fit are dropped
+	config.ProposedPlacements = append(config.ProposedPlacements, ImagePlacement{Source: "tall", RowSpan: 3})
+	placements = MakeGridLayout(&config)
+	assert.Len(t, placements, 5)
+}
+
+// Invalid configurations report all problems and are rejected
+func TestValidateConfig(t *testing.T) {
+	assert.NoError(t, config1.Validate())
+	assert.NoError(t, config2.Validate())
+
+	config := MontageConfig{
+		ID:     "invalid",
+		Resize: "stretch",
+		ProposedPlacements: []ImagePlacement{
+			{Source: "rtsp://camera/stream"},
+			{Source: "file://image.jpeg", Width: 3000},
+		},
+	}
+	err := config.Validate()
+	assert.Error(t, err)
+	for _, problem := range []string{"width 0", "height 0", "rows 0", "resize 'stretch'", "unsupported scheme"} {
+		assert.Contains(t, err.Error(), problem)
+	}
+
+	// fixed widths that exceed the canvas
+	config = *config2
+	config.ProposedPlacements = []ImagePlacement{{Source: "cam1", Width: 1000}, {Source: "cam2", Width: 1000}}
+	config.Rows = 1
+	assert.Error(t, config.Validate())
+
+	// the layout is checked together with the other settings
+	config.Resize = "stretch"
+	err = config.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "resize 'stretch'")
+		assert.Contains(t, err.Error(), "outside the")
+	}
+	config.Resize = config2.Resize
+
+	pub, _ := publisher.NewAppPublisher(AppID, configFolder, appConfig, "", false)
+	app := NewWallpaperApp(appConfig, pub)
+	assert.Nil(t, app.CreateWallpaper(&config))
+	montage := app.CreateWallpaper(config2)
+	app.HandleConfigCommand(config2.ID, types.NodeAttrMap{"rows": "0"})
+	assert.Equal(t, config2.Rows, montage.Config.Rows, "Invalid remote configuration should be rejected")
+}
+
+// Load the wallpaper configuration files in the test folder
+func TestLoadConfig(t *testing.T) {
+	files, _ := filepath.Glob(path.Join(configFolder, AppID+"*.yaml"))
+	assert.NotEmpty(t, files)
+	for _, filename := range files {
+		config := &AppConfig{}
+		err := LoadAppConfig(filename, config)
+		assert.NoError(t, err, "Failed loading %s", filename)
+		assert.NotEmpty(t, config.Wallpapers, filename)
+		for _, wallpaper := range config.Wallpapers {
+			assert.NotEmpty(t, wallpaper.ProposedPlacements, "Wallpaper %s has no images", wallpaper.ID)
+			assert.NoError(t, wallpaper.Validate())
+		}
+	}
+
+	// defaults and aliases
+	config := &AppConfig{}
+	err := LoadAppConfig(path.Join(configFolder, AppID+".yaml"), config)
+	assert.NoError(t, err)
+	screen2 := config.Wallpapers[1]
+	assert.Equal(t, DefaultMontageWidth, screen2.Width)
+	assert.Equal(t, DefaultWaitTime, screen2.WaitTime)
+
+	aliasFile, _ := ioutil.TempFile("", "wallpaper-*.yaml")
+	defer os.Remove(aliasFile.Name())
+	_, _ = aliasFile.WriteString("wallpapers:\n  - ID: screen1\n    updateInterval: 7\n")
+	aliasFile.Close()
+	config = &AppConfig{}
+	err = LoadAppConfig(aliasFile.Name(), config)
+	if assert.NoError(t, err) && assert.Len(t, config.Wallpapers, 1) {
+		assert.Equal(t, 7, config.Wallpapers[0].WaitTime, "updateInterval is an alias of waitTime")
+	}
+
+	// unknown keys are rejected
+	tmpFile, _ := ioutil.TempFile("", "wallpaper-*.yaml")
+	defer os.Remove(tmpFile.Name())
+	_, _ = tmpFile.WriteString("wallpapers:\n  - ID: screen1\n    colums: 2\n")
+	tmpFile.Close()
+	err = LoadAppConfig(tmpFile.Name(), &AppConfig{})
+	assert.Error(t, err)
+}
+
+// Apply a changed configuration to running wallpapers
+func TestApplyAppConfig(t *testing.T) {
+	pub, _ := publisher.NewAppPublisher(AppID, configFolder, appConfig, "", false)
+	app := NewWallpaperApp(&AppConfig{}, pub)
+	app.CreateWallpaper(&config1)
+	montage2 := app.CreateWallpaper(config2)
+	image, _ := ioutil.ReadFile("../test/camera-sshed.jpeg")
+	montage2.UpdateImage("test/ipcam/snowshed/image/0", image)
+	montage2.UpdateImage("test/ipcam/cam7/image/0", image)
+
+	changed2 := *config2
+	changed2.Width = 800
+	changed2.ProposedPlacements = config2.ProposedPlacements[:2]
+	config3 := *config2
+	config3.ID = "screen3"
+	app.ApplyAppConfig(&AppConfig{Wallpapers: []*MontageConfig{&changed2, &config3}})
+
+	assert.Nil(t, app.GetWallpaper(config1.ID), "Removed wallpaper should be deleted")
+	assert.NotNil(t, app.GetWallpaper(config3.ID), "New wallpaper should be created")
+	assert.Same(t, montage2, app.GetWallpaper(config2.ID), "Changed wallpaper should be rebuilt")
+	assert.Equal(t, 800, montage2.canvas.Rect.Max.X)
+	assert.Contains(t, montage2.sourceImages, "test/ipcam/snowshed/image/0", "Latest image of unchanged source is kept")
+	assert.NotContains(t, montage2.sourceImages, "test/ipcam/cam7/image/0")
+
+	// invalid configuration files are ignored
+	err := app.ReloadConfigFile("../test/missing.yaml")
+	assert.Error(t, err)
+	assert.NotNil(t, app.GetWallpaper(config3.ID))
+}
+
+// Reload the configuration file when it changes
+func TestWatchConfigFile(t *testing.T) {
+	folder, _ := ioutil.TempDir("", "wallpaper")
+	defer os.RemoveAll(folder)
+	filename := filepath.Join(folder, AppID+".yaml")
+	writeConfig := func(width int) {
+		yaml := fmt.Sprintf("wallpapers:\n  - ID: screen9\n    width: %d\n    height: 480\n"+
+			"    imagePlacements:\n      - source: test/ipcam/cam6/image/0\n", width)
+		err := ioutil.WriteFile(filename, []byte(yaml), 0644)
+		assert.NoError(t, err)
+	}
+	writeConfig(640)
+	pub, _ := publisher.NewAppPublisher(AppID, configFolder, appConfig, "", false)
+	app := NewWallpaperApp(&AppConfig{}, pub)
+	err := app.WatchConfigFile(filename)
+	assert.NoError(t, err)
+	defer app.StopWatchingConfigFile()
+	assert.Nil(t, app.GetWallpaper("screen9"))
+
+	// changes are applied after the reload delay
+	writeConfig(800)
+	time.Sleep(ConfigReloadDelay / 2)
+	assert.Nil(t, app.GetWallpaper("screen9"), "Reload waits for more changes")
+	time.Sleep(ConfigReloadDelay * 2)
+	montage := app.GetWallpaper("screen9")
+	if assert.NotNil(t, montage, "New wallpaper should be created") {
+		assert.Equal(t, 800, montage.getConfig().Width)
+	}
+
+	writeConfig(1024)
+	time.Sleep(ConfigReloadDelay * 3)
+	assert.Same(t, montage, app.GetWallpaper("screen9"))
+	assert.Equal(t, 1024, montage.getConfig().Width)
+}
+
+// Deleted wallpapers release their montage and ignore late updates
+func TestDeleteWallpaper(t *testing.T) {
+	pub, _ := publisher.NewAppPublisher(AppID, configFolder, appConfig, "", false)
+	app := NewWallpaperApp(&AppConfig{}, pub)
+	montage := app.CreateWallpaper(config2)
+	image, _ := ioutil.ReadFile("../test/camera-sshed.jpeg")
+	montage.UpdateImage("test/ipcam/snowshed/image/0", image)
+
+	app.DeleteWallpaper(config2.ID)
+	assert.Nil(t, app.GetWallpaper(config2.ID))
+	assert.NotContains(t, app.montages, config2.ID)
+	assert.Nil(t, montage.canvas)
+	assert.Equal(t, 0, montage.UpdateCount)
+
+	// late updates from inputs and the update check are ignored
+	input := &types.InputDiscoveryMessage{NodeHWID: config2.ID, Source: "test/ipcam/snowshed/image/0"}
+	app.HandleInputImage(input, "", string(image))
+	montage.UpdateImage("test/ipcam/snowshed/image/0", image)
+	app.CheckUpdateWallpapers(pub)
+	_, err := montage.ExportMontageAsJPEG()
+	assert.Equal(t, ErrMontageReleased, err)
+	app.DeleteWallpaper(config2.ID)
+}
+
+// Create and delete wallpapers and images using remote commands
+func TestRemoteCommands(t *testing.T) {
+	pub, _ := publisher.NewAppPublisher(AppID, configFolder, appConfig, "", false)
+	app := NewWallpaperApp(&AppConfig{}, pub)
+	tmpDir, _ := ioutil.TempDir("", "wallpaper")
+	defer os.RemoveAll(tmpDir)
+	app.configFile = path.Join(tmpDir, AppID+".yaml")
+
+	manager := &types.InputDiscoveryMessage{NodeHWID: ManagerNodeID}
+	app.HandleCreateWallpaper(manager, "", `{"ID": "remote1", "rows": 2, "images": [{"source": "cam1"}]}`)
+	montage := app.GetWallpaper("remote1")
+	assert.NotNil(t, montage)
+	assert.Equal(t, DefaultMontageWidth, montage.Config.Width)
+	// duplicate and reserved IDs are rejected
+	app.HandleCreateWallpaper(manager, "", `{"ID": "remote1", "rows": 1, "images": [{"source": "cam4"}]}`)
+	assert.Equal(t, montage, app.GetWallpaper("remote1"))
+	assert.Equal(t, 2, montage.Config.Rows)
+	app.HandleCreateWallpaper(manager, "", `{"ID": "wallpapers", "rows": 1, "images": [{"source": "cam4"}]}`)
+	assert.Nil(t, app.GetWallpaper(ManagerNodeID))
+
+	wallpaper := &types.InputDiscoveryMessage{NodeHWID: "remote1"}
+	app.HandleAddImage(wallpaper, "", `{"source": "cam2"}`)
+	app.HandleAddImage(wallpaper, "", `{"source": "cam3"}`)
+	assert.Len(t, montage.Config.ProposedPlacements, 3)
+	app.HandleRemoveImage(wallpaper, "", "cam2")
+	app.HandleRemoveImage(wallpaper, "", "0")
+	assert.Equal(t, []ImagePlacement{{Source: "cam3"}}, montage.Config.ProposedPlacements)
+
+	// the changes are saved in the configuration file
+	savedConfig := &AppConfig{}
+	err := LoadAppConfig(app.configFile, savedConfig)
+	assert.NoError(t, err)
+	assert.Len(t, savedConfig.Wallpapers, 1)
+	assert.Equal(t, montage.Config.ProposedPlacements, savedConfig.Wallpapers[0].ProposedPlacements)
+
+	app.HandleDeleteWallpaper(manager, "", "remote1")
+	assert.Nil(t, app.GetWallpaper("remote1"))
+	savedConfig = &AppConfig{}
+	_ = LoadAppConfig(app.configFile, savedConfig)
+	assert.Empty(t, savedConfig.Wallpapers)
+}
+
+// Change an image placement remotely
+func TestRemoteImageConfig(t *testing.T) {
+	pub, _ := publisher.NewAppPublisher(AppID, configFolder, appConfig, "", false)
+	app := NewWallpaperApp(&AppConfig{}, pub)
+	montage := app.CreateWallpaper(config2)
+	image, _ := ioutil.ReadFile("../test/camera-sshed.jpeg")
+	montage.UpdateImage("test/ipcam/snowshed/image/0", image)
+
+	app.HandleConfigCommand(config2.ID, types.NodeAttrMap{
+		"image1/source":   "file://../test/camera-cam6.jpeg",
+		"image1/resize":   "fit",
+		"image1/interval": "60",
+	})
+	placement := montage.Config.ProposedPlacements[1]
+	assert.Equal(t, "file://../test/camera-cam6.jpeg", placement.Source)
+	assert.Equal(t, MontageResizeFit, placement.Resize)
+	assert.Equal(t, 60, placement.Interval)
+	assert.Equal(t, "test/ipcam/kelowna1/image/0", config2.ProposedPlacements[1].Source, "Original configuration is unchanged")
+	assert.Contains(t, montage.sourceImages, "test/ipcam/snowshed/image/0")
+
+	// unknown images are ignored
+	app.HandleConfigCommand(config2.ID, types.NodeAttrMap{"image9/source": "cam9", "image0/color": "red"})
+	assert.Len(t, montage.Config.ProposedPlacements, 4)
+}
+
+// Measure the time spent decoding and encoding the montage
+func TestBuildTimings(t *testing.T) {
+	_, _, montage := newTestWallpaper(t, nil)
+
+	image, _ := ioutil.ReadFile("../test/camera-sshed.jpeg")
+	montage.UpdateImage("test/ipcam/snowshed/image/0", image)
+	_, err := montage.ExportMontageAsJPEG()
+	assert.NoError(t, err)
+
+	timings := montage.TakeBuildTimings()
+	assert.True(t, timings.Decode > 0, "Expected decode time")
+	assert.True(t, timings.Encode > 0, "Expected encode time")
+	assert.Equal(t, timings.Decode+timings.Resize+timings.Draw+timings.Encode, timings.Total())
+	assert.Equal(t, BuildTimings{}, montage.TakeBuildTimings(), "Timings are reset when taken")
+}
+
+// Track the health of image sources and their transitions between healthy and stale
+func TestSourceHealth(t *testing.T) {
+	app, _, montage := newTestWallpaper(t, func(config *MontageConfig) {
+		config.MaxAge = 5
+	})
+	source := "test/ipcam/snowshed/image/0"
+	assert.False(t, montage.GetSourceHealth()[source].Healthy, "Source without images is not healthy")
+
+	image, _ := ioutil.ReadFile("../test/camera-sshed.jpeg")
+	montage.UpdateImage(source, image)
+	montage.UpdateImage(source, []byte("not an image"))
+	health := montage.GetSourceHealth()[source]
+	assert.True(t, health.Healthy)
+	assert.Equal(t, 1, health.DecodeFailures)
+	assert.NotEmpty(t, health.LastError)
+
+	montage.UpdateStaleImages(health.LastUpdate.Add(10 * time.Second))
+	assert.False(t, montage.GetSourceHealth()[source].Healthy, "Source without recent images is stale")
+	changes := montage.TakeHealthChanges()
+	if assert.Len(t, changes, 2) {
+		assert.True(t, changes[0].Healthy)
+		assert.False(t, changes[1].Healthy)
+	}
+	app.publishHealthChanges(montage)
+	app.publishSourceStatus(montage)
+	assert.Empty(t, montage.TakeHealthChanges())
+}
+
+// Report the metrics of sources and builds in the Prometheus text format
+func TestMetrics(t *testing.T) {
+	app, config, montage := newTestWallpaper(t, nil)
+
+	image, _ := ioutil.ReadFile("../test/camera-sshed.jpeg")
+	montage.UpdateImage("test/ipcam/snowshed/image/0", image)
+	montage.UpdateImage("test/ipcam/snowshed/image/0", []byte("not an image"))
+	app.GenerateWallpaperImage(montage)
+
+	response := httptest.NewRecorder()
+	app.ServeMetrics(response, httptest.NewRequest("GET", MetricsPath, nil))
+	metrics := response.Body.String()
+	labels := fmt.Sprintf(`{wallpaper="%s",source="test/ipcam/snowshed/image/0"}`, config.ID)
+	assert.Contains(t, metrics, "wallpaper_source_frames_total"+labels+" 2\n")
+	assert.Contains(t, metrics, "wallpaper_source_decode_errors_total"+labels+" 1\n")
+	assert.Contains(t, metrics, fmt.Sprintf("wallpaper_builds_total{wallpaper=\"%s\"} 1\n", config.ID))
+	assert.Contains(t, metrics, fmt.Sprintf("wallpaper_encode_duration_seconds_count{wallpaper=\"%s\"} 1\n", config.ID))
+	assert.Contains(t, metrics, fmt.Sprintf("wallpaper_canvas_bytes{wallpaper=\"%s\"} %d\n",
+		config.ID, 2*4*config.Width*config.Height))
+
+	app.DeleteWallpaper(config.ID)
+	response = httptest.NewRecorder()
+	app.ServeMetrics(response, httptest.NewRequest("GET", MetricsPath, nil))
+	assert.NotContains(t, response.Body.String(), config.ID)
+}
+
+// Serve the wallpaper, its source images and the index over HTTP
+func TestHTTPServer(t *testing.T) {
+	app, config, montage := newTestWallpaper(t, nil)
+	get := func(url string, etag string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", url, nil)
+		if etag != "" {
+			request.Header.Set("If-None-Match", etag)
+		}
+		response := httptest.NewRecorder()
+		app.ServeWallpapers(response, request)
+		return response
+	}
+	imageURL := WallpapersPath + config.ID + ".jpg"
+	assert.Equal(t, 404, get(imageURL, "").Code, "No image before the wallpaper is generated")
+	assert.Equal(t, 404, get(WallpapersPath+config.ID+"/images/0", "").Code)
+
+	image, _ := ioutil.ReadFile("../test/camera-sshed.jpeg")
+	montage.UpdateImage("test/ipcam/snowshed/image/0", image)
+	app.GenerateWallpaperImage(montage)
+
+	response := get(imageURL, "")
+	assert.Equal(t, 200, response.Code)
+	assert.Equal(t, "image/jpeg", response.Header().Get("Content-Type"))
+	etag := response.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.NotEmpty(t, response.Header().Get("Last-Modified"))
+	assert.Equal(t, 304, get(imageURL, etag).Code)
+
+	response = get(WallpapersPath+config.ID+"/images/0", "")
+	assert.Equal(t, 200, response.Code)
+	assert.Equal(t, image, response.Body.Bytes())
+	assert.Equal(t, 404, get(WallpapersPath+config.ID+"/images/9", "").Code)
+
+	response = get(WallpapersPath, "")
+	assert.Equal(t, 200, response.Code)
+	assert.Contains(t, response.Body.String(), config.ID+".jpg")
+
+	app.DeleteWallpaper(config.ID)
+	assert.Equal(t, 404, get(imageURL, "").Code)
+}
+
+// Stream wallpaper images as MJPEG and drop frames for slow clients
+func TestMJPEGStream(t *testing.T) {
+	app, config, montage := newTestWallpaper(t, nil)
+	server := httptest.NewServer(http.HandlerFunc(app.ServeWallpapers))
+	defer server.Close()
+
+	response, err := http.Get(server.URL + WallpapersPath + config.ID + ".mjpg")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer response.Body.Close()
+	mediaType, params, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	assert.Equal(t, "multipart/x-mixed-replace", mediaType)
+	reader := multipart.NewReader(response.Body, params["boundary"])
+
+	image, _ := ioutil.ReadFile("../test/camera-sshed.jpeg")
+	montage.UpdateImage("test/ipcam/snowshed/image/0", image)
+	app.GenerateWallpaperImage(montage)
+	// the end of a part is only known when the next image arrives, so read its content length
+	part, err := reader.NextPart()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "image/jpeg", part.Header.Get("Content-Type"))
+		length, _ := strconv.Atoi(part.Header.Get("Content-Length"))
+		frame := make([]byte, length)
+		_, err = io.ReadFull(part, frame)
+		assert.NoError(t, err)
+		assert.Equal(t, app.getLatestImage(config.ID).data, frame)
+	}
+
+	// a slow client only keeps the latest frame
+	stream := app.subscribeImages(config.ID)
+	app.storeLatestImage(config.ID, []byte("frame1"), "image/jpeg")
+	app.storeLatestImage(config.ID, []byte("frame2"), "image/jpeg")
+	assert.Len(t, stream.frames, 1)
+	assert.Equal(t, []byte("frame2"), (<-stream.frames).data)
+	app.unsubscribeImages(config.ID, stream)
+
+	// only JPEG wallpapers are streamed
+	pngConfig := *config
+	pngConfig.ID = "png"
+	pngConfig.Format = MontageFormatPNG
+	app.CreateWallpaper(&pngConfig)
+	pngResponse, pngErr := http.Get(server.URL + WallpapersPath + pngConfig.ID + ".mjpg")
+	if assert.NoError(t, pngErr) {
+		assert.Equal(t, 404, pngResponse.StatusCode)
+		pngResponse.Body.Close()
+	}
+
+	// deleting the wallpaper ends the stream
+	app.DeleteWallpaper(config.ID)
+	for err == nil {
+		_, err = reader.NextPart()
+	}
+	assert.Error(t, err)
+}
+
+// Send an event with the changed placements for each new wallpaper image
+func TestEventStream(t *testing.T) {
+	app, config, montage := newTestWallpaper(t, nil)
+	server := httptest.NewServer(http.HandlerFunc(app.ServeEvents))
+	defer server.Close()
+
+	response, err := http.Get(server.URL + EventsPath + "?wallpaper=" + config.ID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer response.Body.Close()
+	assert.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+	reader := bufio.NewReader(response.Body)
+	readEvent := func() (event WallpaperEvent) {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return event
+			}
+			if strings.HasPrefix(line, "data: ") {
+				assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+				return event
+			}
+		}
+	}
+
+	app.GenerateWallpaperImage(montage)
+	event := readEvent()
+	assert.Equal(t, config.ID, event.ID)
+	assert.Equal(t, 1, event.Generation)
+	assert.Len(t, event.ChangedPlacements, len(config.ProposedPlacements), "All placements are new")
+
+	image, _ := ioutil.ReadFile("../test/camera-sshed.jpeg")
+	montage.UpdateImage("test/ipcam/snowshed/image/0", image)
+	app.GenerateWallpaperImage(montage)
+	event = readEvent()
+	assert.Equal(t, 2, event.Generation)
+	assert.Equal(t, []int{0}, event.ChangedPlacements)
+	assert.False(t, event.Timestamp.IsZero())
+
+	// an unchanged image doesn't use a generation or drop the changed placements
+	montage.updateMutex.Lock()
+	montage.changedSources["test/ipcam/cam6/image/0"] = true
+	montage.updateMutex.Unlock()
+	app.GenerateWallpaperImage(montage)
+	image, _ = ioutil.ReadFile("../test/camera-zkioskn.jpeg")
+	montage.UpdateImage("test/ipcam/kelowna1/image/0", image)
+	app.GenerateWallpaperImage(montage)
+	event = readEvent()
+	assert.Equal(t, 3, event.Generation)
+	assert.Equal(t, []int{1, 2}, event.ChangedPlacements)
+}
+
+// Write image files with file mode, history retention and latest link
+func TestFileOutput(t *testing.T) {
+	folder, _ := ioutil.TempDir("", "wallpaper")
+	defer os.RemoveAll(folder)
+	config := *config2
+	config.Filename = filepath.Join(folder, "wallpaper.jpg")
+	config.FileMode = "0640"
+	config.HistoryFolder = filepath.Join(folder, "history")
+	config.HistoryCount = 2
+	config.LatestLink = filepath.Join(folder, "latest.jpg")
+	assert.NoError(t, config.Validate())
+
+	start := time.Now()
+	for index := 0; index < 3; index++ {
+		err := writeImageFiles(&config, []byte{byte(index)}, start.Add(time.Duration(index)*time.Second))
+		assert.NoError(t, err)
+	}
+	info, err := os.Stat(config.Filename)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	}
+	history, _ := filepath.Glob(filepath.Join(config.HistoryFolder, config.ID+"-*.jpg"))
+	assert.Len(t, history, 2, "Only the newest history images are kept")
+	target, err := os.Readlink(config.LatestLink)
+	assert.NoError(t, err)
+	assert.Equal(t, historyImageName(&config, start.Add(2*time.Second)), filepath.Base(target))
+	latest, _ := ioutil.ReadFile(config.LatestLink)
+	assert.Equal(t, []byte{2}, latest)
+
+	// history images older than the max age are removed
+	config.HistoryCount = 0
+	config.HistoryMaxAge = 10
+	err = writeImageFiles(&config, []byte{3}, start.Add(11500*time.Millisecond))
+	assert.NoError(t, err)
+	history, _ = filepath.Glob(filepath.Join(config.HistoryFolder, config.ID+"-*.jpg"))
+	assert.Len(t, history, 2)
+
+	// the montage file is written with the file mode
+	config.FileMode = "0600"
+	err = NewMontage(&config, false).WriteToFile(config.Filename)
+	assert.NoError(t, err)
+	info, err = os.Stat(config.Filename)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	config.FileMode = "rw-r--r--"
+	assert.Error(t, config.Validate())
+}
+
+// Export the montage in each image format with a matching file extension
+func TestOutputFormats(t *testing.T) {
+	config := *config2
+	for _, format := range []MontageFormat{MontageFormatJPEG, MontageFormatPNG, MontageFormatBMP, MontageFormatTIFF} {
+		config.Format = format
+		config.Quality = 95
+		assert.NoError(t, config.Validate())
+		montage := NewMontage(&config, false)
+		data, err := montage.ExportMontage()
+		assert.NoError(t, err)
+		imageConfig, imageType, err := image.DecodeConfig(bytes.NewReader(data))
+		if assert.NoError(t, err, "format %s", format) {
+			assert.Equal(t, config.Width, imageConfig.Width)
+			assert.Equal(t, format.ContentType(), "image/"+imageType)
+		}
+		assert.Equal(t, "montage"+format.FileExt(), config.ImageFilename("montage.bmp"))
+		assert.Equal(t, "montage"+format.FileExt(), config.ImageFilename("montage"+format.FileExt()))
+	}
+	// extensions of the configured format are kept
+	config.Format = ""
+	assert.Equal(t, "montage.jpeg", config.ImageFilename("montage.jpeg"))
+	config.Format = MontageFormatTIFF
+	assert.Equal(t, "montage.TIF", config.ImageFilename("montage.TIF"))
+	config.Format = MontageFormatJPEG
+	config.Progressive = true
+	montage := NewMontage(&config, false)
+	_, err := montage.ExportMontage()
+	assert.NoError(t, err)
+	assert.Equal(t, "montage", config.ImageFilename("montage"))
+
+	// files are written in the configured format
+	folder, _ := ioutil.TempDir("", "wallpaper")
+	defer os.RemoveAll(folder)
+	config.Format = MontageFormatPNG
+	montage = NewMontage(&config, false)
+	err = montage.WriteToFile(filepath.Join(folder, "montage.jpeg"))
+	assert.NoError(t, err)
+	data, _ := ioutil.ReadFile(filepath.Join(folder, "montage.png"))
+	_, imageType, err := image.DecodeConfig(bytes.NewReader(data))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "png", imageType)
+	}
+
+	config.Format = "webp"
+	assert.Error(t, config.Validate())
+	config.Format = MontageFormatPNG
+	config.Quality = 101
+	assert.Error(t, config.Validate())
+}
+
+// Export and save renditions with their own size and format
+func TestRenditions(t *testing.T) {
+	folder, _ := ioutil.TempDir("", "wallpaper")
+	defer os.RemoveAll(folder)
+	app, config, montage := newTestWallpaper(t, func(config *MontageConfig) {
+		config.Renditions = []MontageRendition{
+			{Name: "laptop", Width: 960, Format: MontageFormatPNG, Publish: true},
+			{Name: "phone", Width: 120, Height: 240, Quality: 60, Filename: filepath.Join(folder, "phone.jpg")},
+		}
+	})
+
+	imageData, renditionData, err := montage.ExportMontageWithRenditions()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, imageData)
+	if assert.Len(t, renditionData, 2) {
+		laptop, imageType, _ := image.DecodeConfig(bytes.NewReader(renditionData[0]))
+		assert.Equal(t, "png", imageType)
+		assert.Equal(t, 960, laptop.Width)
+		assert.Equal(t, config.Height*960/config.Width, laptop.Height, "Aspect ratio is kept")
+		phone, imageType, _ := image.DecodeConfig(bytes.NewReader(renditionData[1]))
+		assert.Equal(t, "jpeg", imageType)
+		assert.Equal(t, image.Pt(120, 240), image.Pt(phone.Width, phone.Height))
+	}
+	app.GenerateWallpaperImage(montage)
+	_, err = os.Stat(filepath.Join(folder, "phone.jpg"))
+	assert.NoError(t, err)
+	app.DeleteWallpaper(config.ID)
+
+	config.Renditions = append(config.Renditions, MontageRendition{Name: "phone", Width: 100})
+	assert.Error(t, config.Validate(), "Duplicate rendition name")
+	config.Renditions = []MontageRendition{{Name: "nosize"}}
+	assert.Error(t, config.Validate(), "Rendition without size")
+}
+
+// Identical source images are not redrawn and identical wallpapers not republished
+func TestIdenticalImages(t *testing.T) {
+	app, config, montage := newTestWallpaper(t, func(config *MontageConfig) {
+		config.Filename = ""
+	})
+	source := "test/ipcam/snowshed/image/0"
+
+	// identical source images are not redrawn
+	image, _ := ioutil.ReadFile("../test/camera-sshed.jpeg")
+	montage.UpdateImage(source, image)
+	montage.ResetUpdateCount()
+	montage.UpdateImage(source, image)
+	assert.Equal(t, 0, montage.UpdateCount)
+	health := montage.GetSourceHealth()[source]
+	assert.Equal(t, 2, health.FramesReceived)
+	assert.Equal(t, 1, health.DuplicateFrames)
+
+	// an identical wallpaper image is not published again
+	stream := app.subscribeEvents(config.ID)
+	defer app.unsubscribeEvents(stream)
+	app.GenerateWallpaperImage(montage)
+	app.GenerateWallpaperImage(montage)
+	assert.Len(t, stream.events, 1)
+
+	// a new configuration publishes the image even if it is unchanged
+	newConfig := montage.Config
+	newConfig.Name = "renamed"
+	app.UpdateWallpaper(&newConfig)
+	app.GenerateWallpaperImage(montage)
+	assert.Len(t, stream.events, 2)
+
+	// an image that failed to save is saved again even if it is unchanged
+	newConfig.Filename = filepath.Join(testFolder, "missing", "montage.jpeg")
+	app.UpdateWallpaper(&newConfig)
+	app.GenerateWallpaperImage(montage)
+	app.GenerateWallpaperImage(montage)
+	assert.Len(t, stream.events, 4)
+}
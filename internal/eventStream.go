@@ -0,0 +1,114 @@
+// Package internal with server-sent events of wallpaper updates
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// EventsPath is the path of the server-sent event stream of wallpaper updates
+// Use the 'wallpaper' query parameter to only receive events of one wallpaper.
+const EventsPath = "/events"
+
+// EventKeepAliveInterval is the interval of comments that keep an idle event stream open
+const EventKeepAliveInterval = 30 * time.Second
+
+// eventQueueSize is the number of events queued for a client before the oldest is dropped
+const eventQueueSize = 16
+
+// WallpaperEvent is sent after each new wallpaper image
+type WallpaperEvent struct {
+	ID                string    `json:"id"`                // ID of the wallpaper
+	Generation        int       `json:"generation"`        // number of the wallpaper image since the wallpaper was created
+	Timestamp         time.Time `json:"timestamp"`         // time the image was generated
+	ChangedPlacements []int     `json:"changedPlacements"` // index of the image placements that changed since the previous image
+}
+
+// eventStream is a client of the event stream
+type eventStream struct {
+	wallpaperID string               // only send events of this wallpaper, empty for all wallpapers
+	events      chan *WallpaperEvent // events not yet sent to the client
+}
+
+// pushEvent queues an event for the stream, dropping the oldest event if the client is behind
+// The caller must hold the eventsMutex.
+func (stream *eventStream) pushEvent(event *WallpaperEvent) {
+	for {
+		select {
+		case stream.events <- event:
+			return
+		default:
+		}
+		select {
+		case <-stream.events:
+		default:
+		}
+	}
+}
+
+// publishEvent sends an event to all clients of the event stream
+func (app *WallpaperApp) publishEvent(event *WallpaperEvent) {
+	app.eventsMutex.Lock()
+	defer app.eventsMutex.Unlock()
+	for stream := range app.eventStreams {
+		if stream.wallpaperID == "" || stream.wallpaperID == event.ID {
+			stream.pushEvent(event)
+		}
+	}
+}
+
+// subscribeEvents adds a client of the event stream
+func (app *WallpaperApp) subscribeEvents(wallpaperID string) *eventStream {
+	stream := &eventStream{wallpaperID: wallpaperID, events: make(chan *WallpaperEvent, eventQueueSize)}
+	app.eventsMutex.Lock()
+	defer app.eventsMutex.Unlock()
+	app.eventStreams[stream] = true
+	return stream
+}
+
+// unsubscribeEvents removes a client of the event stream
+func (app *WallpaperApp) unsubscribeEvents(stream *eventStream) {
+	app.eventsMutex.Lock()
+	defer app.eventsMutex.Unlock()
+	delete(app.eventStreams, stream)
+}
+
+// ServeEvents serves the wallpaper events as a text/event-stream
+// The stream ends when the client disconnects.
+func (app *WallpaperApp) ServeEvents(response http.ResponseWriter, request *http.Request) {
+	flusher, canFlush := response.(http.Flusher)
+	if !canFlush {
+		http.Error(response, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	stream := app.subscribeEvents(request.URL.Query().Get("wallpaper"))
+	defer app.unsubscribeEvents(stream)
+	keepAlive := time.NewTicker(EventKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		var err error
+		select {
+		case <-request.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(response, ": keepalive\n\n")
+		case event := <-stream.events:
+			data, _ := json.Marshal(event)
+			_, err = fmt.Fprintf(response, "event: update\ndata: %s\n\n", data)
+		}
+		if err != nil {
+			logrus.Infof("ServeEvents: Client %s disconnected: %s", request.RemoteAddr, err)
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,174 @@
+// Package internal with remote wallpaper commands
+package internal
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// ManagerNodeID is the ID of the node with the inputs to create and delete wallpapers
+const ManagerNodeID = "wallpapers"
+
+// Command inputs to manage wallpapers and their images
+const (
+	InputTypeCreateWallpaper types.InputType = "createWallpaper" // create a wallpaper from a MontageConfig
+	InputTypeDeleteWallpaper types.InputType = "deleteWallpaper" // delete the wallpaper with the given ID
+	InputTypeAddImage        types.InputType = "addImage"        // add an ImagePlacement to a wallpaper
+	InputTypeRemoveImage     types.InputType = "removeImage"     // remove an image by its index or source
+)
+
+// createManagerNode creates the node with inputs to create and delete wallpapers
+func (app *WallpaperApp) createManagerNode() {
+	app.pub.CreateNode(ManagerNodeID, types.NodeTypeAdapter)
+	app.pub.CreateInput(ManagerNodeID, InputTypeCreateWallpaper, types.DefaultInputInstance, app.HandleCreateWallpaper)
+	app.pub.CreateInput(ManagerNodeID, InputTypeDeleteWallpaper, types.DefaultInputInstance, app.HandleDeleteWallpaper)
+}
+
+// createImageCommandInputs creates the inputs to add and remove images of a wallpaper
+func (app *WallpaperApp) createImageCommandInputs(deviceID string) {
+	app.pub.CreateInput(deviceID, InputTypeAddImage, types.DefaultInputInstance, app.HandleAddImage)
+	app.pub.CreateInput(deviceID, InputTypeRemoveImage, types.DefaultInputInstance, app.HandleRemoveImage)
+}
+
+// deleteImageCommandInputs deletes the inputs to add and remove images of a wallpaper
+func (app *WallpaperApp) deleteImageCommandInputs(deviceID string) {
+	app.deleteInput(deviceID, InputTypeAddImage, types.DefaultInputInstance)
+	app.deleteInput(deviceID, InputTypeRemoveImage, types.DefaultInputInstance)
+}
+
+// HandleCreateWallpaper creates a new wallpaper from the MontageConfig in YAML or JSON format
+// The wallpaper is added to the application configuration file.
+func (app *WallpaperApp) HandleCreateWallpaper(input *types.InputDiscoveryMessage, sender string, value string) {
+	logrus.Infof("HandleCreateWallpaper: from '%s'", sender)
+	config := &MontageConfig{}
+	err := yaml.UnmarshalStrict([]byte(value), config)
+	if err != nil {
+		logrus.Errorf("HandleCreateWallpaper: Invalid wallpaper configuration: %s", err)
+		return
+	}
+	if app.CreateWallpaper(config) == nil {
+		return
+	}
+	app.storeWallpaperConfig(config)
+}
+
+// HandleDeleteWallpaper deletes the wallpaper with the given ID
+// The wallpaper is removed from the application configuration file.
+func (app *WallpaperApp) HandleDeleteWallpaper(input *types.InputDiscoveryMessage, sender string, value string) {
+	logrus.Infof("HandleDeleteWallpaper: Wallpaper '%s' from '%s'", value, sender)
+	if app.GetWallpaper(value) == nil {
+		logrus.Errorf("HandleDeleteWallpaper: No wallpaper with ID '%s'", value)
+		return
+	}
+	app.DeleteWallpaper(value)
+	app.removeWallpaperConfig(value)
+}
+
+// HandleAddImage adds the ImagePlacement in YAML or JSON format to the wallpaper of the input node
+func (app *WallpaperApp) HandleAddImage(input *types.InputDiscoveryMessage, sender string, value string) {
+	logrus.Infof("HandleAddImage: Wallpaper '%s' from '%s'", input.NodeHWID, sender)
+	montage := app.GetWallpaper(input.NodeHWID)
+	if montage == nil {
+		logrus.Errorf("HandleAddImage: No wallpaper with ID '%s'", input.NodeHWID)
+		return
+	}
+	placement := ImagePlacement{}
+	err := yaml.UnmarshalStrict([]byte(value), &placement)
+	if err != nil {
+		logrus.Errorf("HandleAddImage: Invalid image configuration: %s", err)
+		return
+	}
+	montage.changeMutex.Lock()
+	defer montage.changeMutex.Unlock()
+	config := montage.getConfig()
+	config.ProposedPlacements = append(append([]ImagePlacement{}, config.ProposedPlacements...), placement)
+	if app.updateWallpaper(montage, &config) != nil {
+		app.storeWallpaperConfig(&config)
+	}
+}
+
+// HandleRemoveImage removes an image from the wallpaper of the input node
+// The value is the index of the image or its source. All images with the source are removed.
+func (app *WallpaperApp) HandleRemoveImage(input *types.InputDiscoveryMessage, sender string, value string) {
+	logrus.Infof("HandleRemoveImage: Image '%s' of wallpaper '%s' from '%s'", value, input.NodeHWID, sender)
+	montage := app.GetWallpaper(input.NodeHWID)
+	if montage == nil {
+		logrus.Errorf("HandleRemoveImage: No wallpaper with ID '%s'", input.NodeHWID)
+		return
+	}
+	montage.changeMutex.Lock()
+	defer montage.changeMutex.Unlock()
+	config := montage.getConfig()
+	placements, err := removePlacement(config.ProposedPlacements, value)
+	if err != nil {
+		logrus.Errorf("HandleRemoveImage: %s", err)
+		return
+	}
+	config.ProposedPlacements = placements
+	if app.updateWallpaper(montage, &config) != nil {
+		app.storeWallpaperConfig(&config)
+	}
+}
+
+// removePlacement returns the placements without the placement with the given index or source
+func removePlacement(placements []ImagePlacement, indexOrSource string) ([]ImagePlacement, error) {
+	index, err := strconv.Atoi(indexOrSource)
+	result := make([]ImagePlacement, 0, len(placements))
+	for i, placement := range placements {
+		if (err == nil && i == index) || (err != nil && placement.Source == indexOrSource) {
+			continue
+		}
+		result = append(result, placement)
+	}
+	if len(result) == len(placements) {
+		return placements, fmt.Errorf("no image '%s'", indexOrSource)
+	}
+	return result, nil
+}
+
+// storeWallpaperConfig adds or replaces the wallpaper in the application configuration and saves it
+func (app *WallpaperApp) storeWallpaperConfig(config *MontageConfig) {
+	app.configMutex.Lock()
+	defer app.configMutex.Unlock()
+	wallpapers := make([]*MontageConfig, 0, len(app.config.Wallpapers)+1)
+	found := false
+	for _, wallpaper := range app.config.Wallpapers {
+		if wallpaper.ID == config.ID {
+			wallpaper = config
+			found = true
+		}
+		wallpapers = append(wallpapers, wallpaper)
+	}
+	if !found {
+		wallpapers = append(wallpapers, config)
+	}
+	app.config.Wallpapers = wallpapers
+	app.saveAppConfig()
+}
+
+// removeWallpaperConfig removes the wallpaper from the application configuration and saves it
+func (app *WallpaperApp) removeWallpaperConfig(ID string) {
+	app.configMutex.Lock()
+	defer app.configMutex.Unlock()
+	wallpapers := make([]*MontageConfig, 0, len(app.config.Wallpapers))
+	for _, wallpaper := range app.config.Wallpapers {
+		if wallpaper.ID != ID {
+			wallpapers = append(wallpapers, wallpaper)
+		}
+	}
+	app.config.Wallpapers = wallpapers
+	app.saveAppConfig()
+}
+
+// saveAppConfig saves the application configuration to the configuration file, if one is set
+// The caller must hold the configMutex.
+func (app *WallpaperApp) saveAppConfig() {
+	if app.configFile == "" {
+		return
+	}
+	_ = SaveAppConfig(app.configFile, app.config)
+}
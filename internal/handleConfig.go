@@ -2,12 +2,182 @@
 package internal
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+
 	"github.com/iotdomain/iotdomain-go/types"
 	"github.com/sirupsen/logrus"
 )
 
 // HandleConfigCommand handles requests to update node configuration
+// The new configuration is applied to the montage of the node, which is rebuilt and redrawn.
+// Configuration that results in an invalid montage is rejected. Changes of a wallpaper are
+// serialized so concurrent changes are not lost.
 func (app *WallpaperApp) HandleConfigCommand(nodeHWID string, config types.NodeAttrMap) {
 	logrus.Infof("Wallpaper.HandleConfigCommand for node %s. ", nodeHWID)
+
+	montage := app.GetWallpaper(nodeHWID)
+	if montage == nil {
+		logrus.Warningf("Wallpaper.HandleConfigCommand: No wallpaper with ID %s", nodeHWID)
+		return
+	}
+	montage.changeMutex.Lock()
+	defer montage.changeMutex.Unlock()
+	newConfig := montage.getConfig()
+	applyNodeConfig(&newConfig, config)
+	if err := newConfig.Validate(); err != nil {
+		logrus.Errorf("Wallpaper.HandleConfigCommand: Rejected configuration for node %s: %s", nodeHWID, err)
+		return
+	}
 	app.pub.UpdateNodeConfigValues(nodeHWID, config)
+	app.updateWallpaper(montage, &newConfig)
+}
+
+// applyNodeConfig updates the montage configuration with the node configuration values
+// Invalid values are logged and ignored.
+func applyNodeConfig(montageConfig *MontageConfig, config types.NodeAttrMap) {
+	// image placements are changed on a copy to leave the current configuration intact
+	montageConfig.ProposedPlacements = append([]ImagePlacement{}, montageConfig.ProposedPlacements...)
+	for attrName, value := range config {
+		var err error
+		if strings.HasPrefix(string(attrName), ImageConfigPrefix) {
+			err = applyImageConfig(montageConfig.ProposedPlacements, attrName, value)
+			if err != nil {
+				logrus.Errorf("applyNodeConfig: Invalid value '%s' for configuration '%s': %s", value, attrName, err)
+			}
+			continue
+		}
+		switch attrName {
+		case "border":
+			err = parseIntConfig(value, &montageConfig.Border)
+		case "height":
+			err = parseIntConfig(value, &montageConfig.Height)
+		case "width":
+			err = parseIntConfig(value, &montageConfig.Width)
+		case "rows":
+			err = parseIntConfig(value, &montageConfig.Rows)
+		case "publish":
+			var publish bool
+			publish, err = strconv.ParseBool(value)
+			if err == nil {
+				montageConfig.Publish = publish
+			}
+		case "resize":
+			montageConfig.Resize = MontageResize(value)
+		case "format":
+			montageConfig.Format = MontageFormat(value)
+		case "quality":
+			err = parseIntConfig(value, &montageConfig.Quality)
+		default:
+			logrus.Warningf("applyNodeConfig: Ignored unknown configuration '%s'", attrName)
+		}
+		if err != nil {
+			logrus.Errorf("applyNodeConfig: Invalid value '%s' for configuration '%s': %s", value, attrName, err)
+		}
+	}
+}
+
+// parseIntConfig parses an integer configuration value
+// The target is only updated if the value is a valid integer.
+func parseIntConfig(value string, target *int) error {
+	intValue, err := strconv.Atoi(value)
+	if err == nil {
+		*target = intValue
+	}
+	return err
+}
+
+// ImageConfigPrefix is the prefix of the node configuration attributes of image placements
+// The attribute name is {prefix}{index}/{attribute}, for example 'image0/source'.
+// These are node attributes rather than configuration of the image inputs, as the publisher only
+// passes configuration commands for nodes to the SetNodeConfigHandler, and an image input is
+// recreated when its source changes.
+const ImageConfigPrefix = "image"
+
+// imageConfigAttrs holds the node configuration attributes of each image placement
+var imageConfigAttrs = []string{"source", "resize", "interval", "x", "y", "width", "height"}
+
+// imageConfigName returns the node configuration attribute name of an image placement attribute
+func imageConfigName(index int, attrName string) types.NodeAttr {
+	return types.NodeAttr(fmt.Sprintf("%s%d/%s", ImageConfigPrefix, index, attrName))
+}
+
+// publishImageConfig publishes the source, resize, poll interval and geometry of each image
+// placement as node configuration, so they can be viewed and changed remotely.
+func (app *WallpaperApp) publishImageConfig(config *MontageConfig) {
+	values := types.NodeAttrMap{}
+	for index, placement := range config.ProposedPlacements {
+		app.pub.UpdateNodeConfig(config.ID, imageConfigName(index, "source"), &types.ConfigAttr{
+			DataType:    types.DataTypeString,
+			Description: fmt.Sprintf("Source of image %d. Output address, file:// or http:// URL", index),
+		})
+		app.pub.UpdateNodeConfig(config.ID, imageConfigName(index, "resize"), &types.ConfigAttr{
+			DataType:    types.DataTypeEnum,
+			Description: fmt.Sprintf("Resize of image %d instead of the wallpaper resize", index),
+			Enum:        []string{"", "scale", "crop", "fit", "none", "height", "width"},
+		})
+		app.pub.UpdateNodeConfig(config.ID, imageConfigName(index, "interval"), &types.ConfigAttr{
+			DataType:    types.DataTypeInt,
+			Description: fmt.Sprintf("Interval in seconds to poll the http source of image %d", index),
+			Min:         0,
+		})
+		for _, geometry := range []string{"x", "y", "width", "height"} {
+			app.pub.UpdateNodeConfig(config.ID, imageConfigName(index, geometry), &types.ConfigAttr{
+				DataType:    types.DataTypeInt,
+				Description: fmt.Sprintf("Optional %s of image %d, 0 is automatic", geometry, index),
+				Min:         0,
+			})
+		}
+		values[imageConfigName(index, "source")] = placement.Source
+		values[imageConfigName(index, "resize")] = string(placement.Resize)
+		values[imageConfigName(index, "interval")] = strconv.Itoa(placement.Interval)
+		values[imageConfigName(index, "x")] = strconv.Itoa(placement.X)
+		values[imageConfigName(index, "y")] = strconv.Itoa(placement.Y)
+		values[imageConfigName(index, "width")] = strconv.Itoa(placement.Width)
+		values[imageConfigName(index, "height")] = strconv.Itoa(placement.Height)
+	}
+	app.pub.UpdateNodeConfigValues(config.ID, values)
+}
+
+// clearImageConfig clears the node configuration values of the images from firstIndex up to endIndex
+// This is used for images that are removed, as the publisher has no means to remove node configuration.
+func (app *WallpaperApp) clearImageConfig(wallpaperID string, firstIndex int, endIndex int) {
+	values := types.NodeAttrMap{}
+	for index := firstIndex; index < endIndex; index++ {
+		for _, attrName := range imageConfigAttrs {
+			values[imageConfigName(index, attrName)] = ""
+		}
+	}
+	app.pub.UpdateNodeConfigValues(wallpaperID, values)
+}
+
+// applyImageConfig updates an image placement with a node configuration value
+func applyImageConfig(placements []ImagePlacement, attrName types.NodeAttr, value string) error {
+	parts := strings.SplitN(strings.TrimPrefix(string(attrName), ImageConfigPrefix), "/", 2)
+	index, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) != 2 || index < 0 || index >= len(placements) {
+		return fmt.Errorf("unknown image configuration")
+	}
+	imageAttr := parts[1]
+	placement := &placements[index]
+	switch imageAttr {
+	case "source":
+		placement.Source = value
+	case "resize":
+		placement.Resize = MontageResize(value)
+	case "interval":
+		err = parseIntConfig(value, &placement.Interval)
+	case "x":
+		err = parseIntConfig(value, &placement.X)
+	case "y":
+		err = parseIntConfig(value, &placement.Y)
+	case "width":
+		err = parseIntConfig(value, &placement.Width)
+	case "height":
+		err = parseIntConfig(value, &placement.Height)
+	default:
+		err = fmt.Errorf("unknown image attribute '%s'", imageAttr)
+	}
+	return err
 }
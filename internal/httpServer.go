@@ -0,0 +1,209 @@
+// Package internal with the HTTP server of wallpaper images
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// WallpapersPath is the path of the wallpaper index. Images are served at {path}{id}.{ext} with the
+// extension of the image format, the MJPEG stream of JPEG wallpapers at {path}{id}.mjpg and the latest image of each
+// source at {path}{id}/images/{index}.
+const WallpapersPath = "/wallpapers/"
+
+// wallpaperImage holds the latest image of a wallpaper
+type wallpaperImage struct {
+	data        []byte    // encoded image
+	contentType string    // MIME type of the image
+	modTime     time.Time // time the image was generated
+	etag        string    // quoted hash of the image
+}
+
+// makeETag returns the quoted entity tag of the data
+func makeETag(data []byte) string {
+	hash := sha1.Sum(data)
+	return `"` + hex.EncodeToString(hash[:12]) + `"`
+}
+
+// storeLatestImage keeps the latest image of a wallpaper to serve over HTTP
+func (app *WallpaperApp) storeLatestImage(wallpaperID string, data []byte, contentType string) {
+	latest := &wallpaperImage{data: data, contentType: contentType, modTime: time.Now(), etag: makeETag(data)}
+	app.imagesMutex.Lock()
+	defer app.imagesMutex.Unlock()
+	app.latestImages[wallpaperID] = latest
+	app.broadcastImage(wallpaperID, latest)
+}
+
+// deleteLatestImage removes the latest image of a deleted wallpaper and ends its streams
+func (app *WallpaperApp) deleteLatestImage(wallpaperID string) {
+	app.imagesMutex.Lock()
+	defer app.imagesMutex.Unlock()
+	delete(app.latestImages, wallpaperID)
+	app.closeImageStreams(wallpaperID)
+}
+
+// getLatestImage returns the latest image of a wallpaper, or nil if none was generated
+func (app *WallpaperApp) getLatestImage(wallpaperID string) *wallpaperImage {
+	app.imagesMutex.RLock()
+	defer app.imagesMutex.RUnlock()
+	return app.latestImages[wallpaperID]
+}
+
+// serveImage serves image data with its ETag and modification time
+// Conditional requests with If-None-Match or If-Modified-Since are answered with 304 Not Modified.
+func serveImage(response http.ResponseWriter, request *http.Request, name string, image *wallpaperImage) {
+	response.Header().Set("ETag", image.etag)
+	response.Header().Set("Cache-Control", "no-cache")
+	response.Header().Set("Content-Type", image.contentType)
+	http.ServeContent(response, request, name, image.modTime, bytes.NewReader(image.data))
+}
+
+// indexTemplate is the HTML page listing the wallpapers
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Wallpapers</title></head>
+<body>
+<h1>Wallpapers</h1>
+<ul>
+{{range .}}<li><a href="{{.ID}}{{.Format.FileExt}}">{{.Name}}</a> ({{if eq .Format.ContentType "image/jpeg"}}<a href="{{.ID}}.mjpg">live</a>, {{end}}{{.ID}}, {{.Width}}x{{.Height}})
+<ul>{{$id := .ID}}{{range $index, $placement := .ProposedPlacements}}<li><a href="{{$id}}/images/{{$index}}">{{$placement.Source}}</a></li>{{end}}</ul>
+</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+// ServeWallpapers handles requests for the wallpaper index, the wallpaper images and the
+// latest image of each source.
+func (app *WallpaperApp) ServeWallpapers(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		http.Error(response, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(request.URL.Path, WallpapersPath)
+	if name == "" {
+		app.serveIndex(response)
+		return
+	}
+	parts := strings.Split(name, "/")
+	if len(parts) == 1 && strings.HasSuffix(name, ".mjpg") {
+		app.serveStream(response, request, strings.TrimSuffix(name, ".mjpg"))
+		return
+	}
+	if len(parts) == 1 {
+		app.serveWallpaperImage(response, request, name)
+		return
+	}
+	if len(parts) == 3 && parts[1] == "images" {
+		app.serveSourceImage(response, request, parts[0], parts[2])
+		return
+	}
+	http.NotFound(response, request)
+}
+
+// serveWallpaperImage serves the latest image of a wallpaper
+// The name is the wallpaper ID with the file extension of its image format.
+func (app *WallpaperApp) serveWallpaperImage(response http.ResponseWriter, request *http.Request, name string) {
+	ext := path.Ext(name)
+	montage := app.GetWallpaper(strings.TrimSuffix(name, ext))
+	if montage == nil {
+		http.NotFound(response, request)
+		return
+	}
+	config := montage.getConfig()
+	if ext != config.Format.FileExt() {
+		http.NotFound(response, request)
+		return
+	}
+	latest := app.getLatestImage(config.ID)
+	if latest == nil {
+		http.NotFound(response, request)
+		return
+	}
+	serveImage(response, request, name, latest)
+}
+
+// serveIndex serves the HTML page listing the wallpapers
+func (app *WallpaperApp) serveIndex(response http.ResponseWriter) {
+	app.montagesMutex.RLock()
+	configs := make([]*MontageConfig, 0, len(app.montages))
+	for _, montage := range app.montages {
+		config := montage.getConfig()
+		configs = append(configs, &config)
+	}
+	app.montagesMutex.RUnlock()
+	sort.Slice(configs, func(i, j int) bool { return configs[i].ID < configs[j].ID })
+
+	response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := indexTemplate.Execute(response, configs)
+	if err != nil {
+		logrus.Errorf("serveIndex: %s", err)
+	}
+}
+
+// serveSourceImage serves the latest image of the source of the placement with the given index
+func (app *WallpaperApp) serveSourceImage(response http.ResponseWriter, request *http.Request, wallpaperID string, indexName string) {
+	montage := app.GetWallpaper(wallpaperID)
+	index, err := strconv.Atoi(indexName)
+	if montage == nil || err != nil {
+		http.NotFound(response, request)
+		return
+	}
+	data, modTime := montage.GetSourceImage(index)
+	if data == nil {
+		http.NotFound(response, request)
+		return
+	}
+	serveImage(response, request, indexName, &wallpaperImage{
+		data: data, contentType: http.DetectContentType(data), modTime: modTime, etag: makeETag(data)})
+}
+
+// startServer starts an HTTP server with the handler on the given address
+func startServer(address string, handler http.Handler) *http.Server {
+	server := &http.Server{Addr: address, Handler: handler}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("startServer: Server on %s failed: %s", address, err)
+		}
+	}()
+	return server
+}
+
+// stopServer gracefully stops an HTTP server, if started
+func stopServer(server *http.Server) {
+	if server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_ = server.Shutdown(ctx)
+}
+
+// StartHTTPServer starts the HTTP server of the wallpaper images on the given address
+// The server also serves the event stream and the metrics endpoint.
+func (app *WallpaperApp) StartHTTPServer(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(WallpapersPath, app.ServeWallpapers)
+	mux.HandleFunc(EventsPath, app.ServeEvents)
+	mux.HandleFunc(MetricsPath, app.ServeMetrics)
+	logrus.Infof("StartHTTPServer: Serving wallpapers on http://%s%s", address, WallpapersPath)
+	app.httpServer = startServer(address, mux)
+}
+
+// StopHTTPServer stops the HTTP server of the wallpaper images, if started
+func (app *WallpaperApp) StopHTTPServer() {
+	stopServer(app.httpServer)
+	app.httpServer = nil
+}
@@ -0,0 +1,94 @@
+// Package internal with wallpaper configuration loading
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Montage configuration defaults, matching the defaults of the node configuration
+const (
+	DefaultMontageWidth  = 1920
+	DefaultMontageHeight = 1080
+	DefaultMontageRows   = 1
+)
+
+// montageConfigYAML is the MontageConfig without its yaml unmarshaller
+type montageConfigYAML MontageConfig
+
+// montageConfigAliases holds the deprecated key aliases of the montage configuration
+type montageConfigAliases struct {
+	montageConfigYAML `yaml:",inline"`
+	ImagePlacements   []ImagePlacement `yaml:"imagePlacements,omitempty"` // alias of 'images'
+	UpdateInterval    int              `yaml:"updateInterval,omitempty"`  // alias of 'waitTime'
+}
+
+// UnmarshalYAML decodes a montage configuration, supporting key aliases and filling in defaults
+func (config *MontageConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	aliases := montageConfigAliases{montageConfigYAML: montageConfigYAML{
+		Width:    DefaultMontageWidth,
+		Height:   DefaultMontageHeight,
+		Rows:     DefaultMontageRows,
+		WaitTime: DefaultWaitTime,
+	}}
+	err := unmarshal(&aliases)
+	if err != nil {
+		return err
+	}
+	*config = MontageConfig(aliases.montageConfigYAML)
+	if len(aliases.ImagePlacements) > 0 {
+		config.ProposedPlacements = append(config.ProposedPlacements, aliases.ImagePlacements...)
+	}
+	if aliases.UpdateInterval > 0 {
+		config.WaitTime = aliases.UpdateInterval
+	}
+	return nil
+}
+
+// DefaultConfigFolder returns the folder that holds the application configuration file
+func DefaultConfigFolder() string {
+	homeFolder, _ := os.UserHomeDir()
+	return path.Join(homeFolder, ".config", "iotdomain")
+}
+
+// LoadAppConfig loads the application configuration from the given yaml file
+// Unknown keys are rejected to catch mistakes in the configuration.
+func LoadAppConfig(filename string, config *AppConfig) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		logrus.Errorf("LoadAppConfig: Unable to read configuration file %s: %s", filename, err)
+		return err
+	}
+	err = yaml.UnmarshalStrict(data, config)
+	if err != nil {
+		logrus.Errorf("LoadAppConfig: Invalid configuration file %s: %s", filename, err)
+		return err
+	}
+	logrus.Infof("LoadAppConfig: Loaded %d wallpapers from %s", len(config.Wallpapers), filename)
+	return nil
+}
+
+// SaveAppConfig saves the application configuration to the given yaml file
+// The file is written to a temporary file first and then renamed, so it is never partially written.
+func SaveAppConfig(filename string, config *AppConfig) error {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		logrus.Errorf("SaveAppConfig: Unable to encode configuration: %s", err)
+		return err
+	}
+	tmpFilename := filename + ".tmp"
+	err = ioutil.WriteFile(tmpFilename, data, 0600)
+	if err == nil {
+		err = os.Rename(tmpFilename, filename)
+	}
+	if err != nil {
+		logrus.Errorf("SaveAppConfig: Unable to save configuration file %s: %s", filename, err)
+		return err
+	}
+	logrus.Infof("SaveAppConfig: Saved %d wallpapers to %s", len(config.Wallpapers), filename)
+	return nil
+}
@@ -0,0 +1,203 @@
+// Package internal with Prometheus-style metrics of the wallpapers
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MetricsPath is the path of the metrics endpoint
+const MetricsPath = "/metrics"
+
+// encodeDurationBuckets are the upper bounds in seconds of the encode duration histogram
+var encodeDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// durationHistogram is a cumulative histogram of durations in seconds
+type durationHistogram struct {
+	bucketCounts []uint64 // count of observations less or equal to each bucket upper bound
+	count        uint64   // total number of observations
+	sum          float64  // sum of all observations
+}
+
+// observe adds a duration to the histogram
+func (histogram *durationHistogram) observe(duration time.Duration) {
+	seconds := duration.Seconds()
+	for index, upperBound := range encodeDurationBuckets {
+		if seconds <= upperBound {
+			histogram.bucketCounts[index]++
+		}
+	}
+	histogram.count++
+	histogram.sum += seconds
+}
+
+// WallpaperMetrics holds the counters of building and publishing wallpaper images
+// Source counters are kept by the montage health and the canvas size is read from the montage.
+type WallpaperMetrics struct {
+	mutex          sync.Mutex
+	builds         map[string]uint64             // number of images built per wallpaper
+	outputBytes    map[string]uint64             // number of image bytes produced per wallpaper
+	encodeDuration map[string]*durationHistogram // encode duration per wallpaper
+}
+
+// recordBuild records a wallpaper image that was built
+func (metrics *WallpaperMetrics) recordBuild(wallpaperID string, encodeDuration time.Duration, outputBytes int) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.builds[wallpaperID]++
+	metrics.outputBytes[wallpaperID] += uint64(outputBytes)
+	histogram := metrics.encodeDuration[wallpaperID]
+	if histogram == nil {
+		histogram = &durationHistogram{bucketCounts: make([]uint64, len(encodeDurationBuckets))}
+		metrics.encodeDuration[wallpaperID] = histogram
+	}
+	histogram.observe(encodeDuration)
+}
+
+// deleteWallpaper removes the metrics of a deleted wallpaper
+func (metrics *WallpaperMetrics) deleteWallpaper(wallpaperID string) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	delete(metrics.builds, wallpaperID)
+	delete(metrics.outputBytes, wallpaperID)
+	delete(metrics.encodeDuration, wallpaperID)
+}
+
+// NewWallpaperMetrics creates an empty set of wallpaper metrics
+func NewWallpaperMetrics() *WallpaperMetrics {
+	return &WallpaperMetrics{
+		builds:         make(map[string]uint64),
+		outputBytes:    make(map[string]uint64),
+		encodeDuration: make(map[string]*durationHistogram),
+	}
+}
+
+// escapeLabel escapes a label value for the text exposition format
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// writeMetricHeader writes the help and type lines of a metric
+func writeMetricHeader(writer io.Writer, name string, metricType string, help string) {
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// WriteMetrics writes the metrics of all wallpapers in the Prometheus text exposition format
+func (app *WallpaperApp) WriteMetrics(writer io.Writer) {
+	// montages are labelled by the wallpaper ID of their configuration
+	type wallpaperMontage struct {
+		wallpaperID string
+		montage     *Montage
+	}
+	app.montagesMutex.RLock()
+	montages := make([]wallpaperMontage, 0, len(app.montages))
+	for _, montage := range app.montages {
+		montages = append(montages, wallpaperMontage{montage.getConfig().ID, montage})
+	}
+	app.montagesMutex.RUnlock()
+	sort.Slice(montages, func(i, j int) bool { return montages[i].wallpaperID < montages[j].wallpaperID })
+
+	// source metrics are labelled by wallpaper and source
+	type sourceMetric struct {
+		wallpaperID string
+		health      SourceHealth
+	}
+	sourceMetrics := make([]sourceMetric, 0)
+	for _, wallpaper := range montages {
+		healthMap := wallpaper.montage.GetSourceHealth()
+		sources := make([]string, 0, len(healthMap))
+		for source := range healthMap {
+			sources = append(sources, source)
+		}
+		sort.Strings(sources)
+		for _, source := range sources {
+			sourceMetrics = append(sourceMetrics, sourceMetric{wallpaper.wallpaperID, healthMap[source]})
+		}
+	}
+	writeMetricHeader(writer, "wallpaper_source_frames_total", "counter", "Number of images received from the source.")
+	for _, metric := range sourceMetrics {
+		fmt.Fprintf(writer, "wallpaper_source_frames_total{wallpaper=\"%s\",source=\"%s\"} %d\n",
+			escapeLabel(metric.wallpaperID), escapeLabel(metric.health.Source), metric.health.FramesReceived)
+	}
+	writeMetricHeader(writer, "wallpaper_source_duplicate_frames_total", "counter", "Number of images of the source that were identical to the image shown.")
+	for _, metric := range sourceMetrics {
+		fmt.Fprintf(writer, "wallpaper_source_duplicate_frames_total{wallpaper=\"%s\",source=\"%s\"} %d\n",
+			escapeLabel(metric.wallpaperID), escapeLabel(metric.health.Source), metric.health.DuplicateFrames)
+	}
+	writeMetricHeader(writer, "wallpaper_source_decode_errors_total", "counter", "Number of images of the source that failed to decode.")
+	for _, metric := range sourceMetrics {
+		fmt.Fprintf(writer, "wallpaper_source_decode_errors_total{wallpaper=\"%s\",source=\"%s\"} %d\n",
+			escapeLabel(metric.wallpaperID), escapeLabel(metric.health.Source), metric.health.DecodeFailures)
+	}
+	writeMetricHeader(writer, "wallpaper_source_healthy", "gauge", "1 if the source delivers images that are not stale.")
+	for _, metric := range sourceMetrics {
+		healthy := 0
+		if metric.health.Healthy {
+			healthy = 1
+		}
+		fmt.Fprintf(writer, "wallpaper_source_healthy{wallpaper=\"%s\",source=\"%s\"} %d\n",
+			escapeLabel(metric.wallpaperID), escapeLabel(metric.health.Source), healthy)
+	}
+
+	writeMetricHeader(writer, "wallpaper_canvas_bytes", "gauge", "Memory used by the canvas of the wallpaper.")
+	for _, wallpaper := range montages {
+		fmt.Fprintf(writer, "wallpaper_canvas_bytes{wallpaper=\"%s\"} %d\n",
+			escapeLabel(wallpaper.wallpaperID), wallpaper.montage.CanvasBytes())
+	}
+
+	metrics := app.metrics
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	writeMetricHeader(writer, "wallpaper_builds_total", "counter", "Number of wallpaper images built.")
+	for _, wallpaper := range montages {
+		fmt.Fprintf(writer, "wallpaper_builds_total{wallpaper=\"%s\"} %d\n",
+			escapeLabel(wallpaper.wallpaperID), metrics.builds[wallpaper.wallpaperID])
+	}
+	writeMetricHeader(writer, "wallpaper_output_bytes_total", "counter", "Number of bytes of the wallpaper images built.")
+	for _, wallpaper := range montages {
+		fmt.Fprintf(writer, "wallpaper_output_bytes_total{wallpaper=\"%s\"} %d\n",
+			escapeLabel(wallpaper.wallpaperID), metrics.outputBytes[wallpaper.wallpaperID])
+	}
+	writeMetricHeader(writer, "wallpaper_encode_duration_seconds", "histogram", "Time to encode the wallpaper image.")
+	for _, wallpaper := range montages {
+		histogram := metrics.encodeDuration[wallpaper.wallpaperID]
+		if histogram == nil {
+			continue
+		}
+		label := escapeLabel(wallpaper.wallpaperID)
+		for index, upperBound := range encodeDurationBuckets {
+			fmt.Fprintf(writer, "wallpaper_encode_duration_seconds_bucket{wallpaper=\"%s\",le=\"%g\"} %d\n",
+				label, upperBound, histogram.bucketCounts[index])
+		}
+		fmt.Fprintf(writer, "wallpaper_encode_duration_seconds_bucket{wallpaper=\"%s\",le=\"+Inf\"} %d\n", label, histogram.count)
+		fmt.Fprintf(writer, "wallpaper_encode_duration_seconds_sum{wallpaper=\"%s\"} %g\n", label, histogram.sum)
+		fmt.Fprintf(writer, "wallpaper_encode_duration_seconds_count{wallpaper=\"%s\"} %d\n", label, histogram.count)
+	}
+}
+
+// ServeMetrics handles requests for the metrics endpoint
+func (app *WallpaperApp) ServeMetrics(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	app.WriteMetrics(response)
+}
+
+// StartMetricsServer starts the HTTP server of the metrics endpoint on the given address
+func (app *WallpaperApp) StartMetricsServer(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(MetricsPath, app.ServeMetrics)
+	logrus.Infof("StartMetricsServer: Serving metrics on http://%s%s", address, MetricsPath)
+	app.metricsServer = startServer(address, mux)
+}
+
+// StopMetricsServer stops the HTTP server of the metrics endpoint, if started
+func (app *WallpaperApp) StopMetricsServer() {
+	stopServer(app.metricsServer)
+	app.metricsServer = nil
+}
@@ -0,0 +1,126 @@
+// Package internal with MJPEG streaming of wallpaper images
+package internal
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// mjpegBoundary separates the images in the MJPEG stream
+const mjpegBoundary = "wallpaperframe"
+
+// mjpegContentType is the content type of the images in the MJPEG stream
+const mjpegContentType = "image/jpeg"
+
+// imageStream is a client of the MJPEG stream of a wallpaper
+// The frames channel holds at most one pending image. A slow client drops older images
+// so generating wallpaper images never blocks.
+type imageStream struct {
+	frames chan *wallpaperImage
+}
+
+// pushFrame queues an image for the stream, replacing the pending image if the client is behind
+// The caller must hold the imagesMutex.
+func (stream *imageStream) pushFrame(latest *wallpaperImage) {
+	select {
+	case <-stream.frames:
+		// drop the frame the client hasn't taken yet
+	default:
+	}
+	select {
+	case stream.frames <- latest:
+	default:
+	}
+}
+
+// subscribeImages adds a stream for the images of a wallpaper
+// The latest image, if any, is queued immediately.
+func (app *WallpaperApp) subscribeImages(wallpaperID string) *imageStream {
+	stream := &imageStream{frames: make(chan *wallpaperImage, 1)}
+	app.imagesMutex.Lock()
+	defer app.imagesMutex.Unlock()
+	if app.imageStreams[wallpaperID] == nil {
+		app.imageStreams[wallpaperID] = make(map[*imageStream]bool)
+	}
+	app.imageStreams[wallpaperID][stream] = true
+	if latest := app.latestImages[wallpaperID]; latest != nil {
+		stream.pushFrame(latest)
+	}
+	return stream
+}
+
+// unsubscribeImages removes a stream for the images of a wallpaper
+func (app *WallpaperApp) unsubscribeImages(wallpaperID string, stream *imageStream) {
+	app.imagesMutex.Lock()
+	defer app.imagesMutex.Unlock()
+	delete(app.imageStreams[wallpaperID], stream)
+	if len(app.imageStreams[wallpaperID]) == 0 {
+		delete(app.imageStreams, wallpaperID)
+	}
+}
+
+// broadcastImage queues the latest image of a wallpaper for all its streams
+// The caller must hold the imagesMutex.
+func (app *WallpaperApp) broadcastImage(wallpaperID string, latest *wallpaperImage) {
+	for stream := range app.imageStreams[wallpaperID] {
+		stream.pushFrame(latest)
+	}
+}
+
+// closeImageStreams ends all streams of a deleted wallpaper
+// The caller must hold the imagesMutex.
+func (app *WallpaperApp) closeImageStreams(wallpaperID string) {
+	for stream := range app.imageStreams[wallpaperID] {
+		close(stream.frames)
+	}
+	delete(app.imageStreams, wallpaperID)
+}
+
+// serveStream serves the wallpaper images as a multipart/x-mixed-replace MJPEG stream
+// Only wallpapers in the JPEG format can be streamed. The stream ends when the client disconnects,
+// the wallpaper is deleted or its format is changed.
+func (app *WallpaperApp) serveStream(response http.ResponseWriter, request *http.Request, wallpaperID string) {
+	flusher, canFlush := response.(http.Flusher)
+	montage := app.GetWallpaper(wallpaperID)
+	if montage == nil || !canFlush || montage.getConfig().Format.ContentType() != mjpegContentType {
+		http.NotFound(response, request)
+		return
+	}
+	stream := app.subscribeImages(wallpaperID)
+	defer app.unsubscribeImages(wallpaperID, stream)
+	logrus.Infof("serveStream: Client %s connected to the stream of wallpaper %s", request.RemoteAddr, wallpaperID)
+
+	response.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+	response.Header().Set("Cache-Control", "no-cache")
+	response.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		case frame, isOpen := <-stream.frames:
+			if !isOpen {
+				return
+			}
+			if frame.contentType != mjpegContentType {
+				logrus.Infof("serveStream: Wallpaper %s is no longer a JPEG image. Ending stream.", wallpaperID)
+				return
+			}
+			_, err := fmt.Fprintf(response, "--%s\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n",
+				mjpegBoundary, frame.contentType, len(frame.data))
+			if err == nil {
+				_, err = response.Write(frame.data)
+			}
+			if err == nil {
+				_, err = response.Write([]byte("\r\n"))
+			}
+			if err != nil {
+				logrus.Infof("serveStream: Client %s of wallpaper %s disconnected: %s", request.RemoteAddr, wallpaperID, err)
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
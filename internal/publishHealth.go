@@ -0,0 +1,69 @@
+// Package internal with publication of the health of wallpaper image sources
+package internal
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+)
+
+// OutputTypeSourceHealth is the output with events of image sources that become healthy or stale
+const OutputTypeSourceHealth types.OutputType = "sourceHealth"
+
+// imageStatusNames holds the node status names of each image placement
+var imageStatusNames = []string{"healthy", "lastUpdate", "lastError", "decodeFailures", "frameRate"}
+
+// imageStatusName returns the node status attribute name of an image placement status
+// The name is {prefix}{index}/{status}, for example 'image0/healthy'.
+func imageStatusName(index int, statusName string) types.NodeStatusAttr {
+	return types.NodeStatusAttr(imageConfigName(index, statusName))
+}
+
+// publishSourceStatus publishes the health of the source of each image placement as node status
+func (app *WallpaperApp) publishSourceStatus(montage *Montage) {
+	config := montage.getConfig()
+	healthMap := montage.GetSourceHealth()
+	status := types.NodeStatusMap{}
+	for index, placement := range config.ProposedPlacements {
+		health := healthMap[placement.Source]
+		lastUpdate := ""
+		if !health.LastUpdate.IsZero() {
+			lastUpdate = health.LastUpdate.Format(time.RFC3339)
+		}
+		status[imageStatusName(index, "healthy")] = strconv.FormatBool(health.Healthy)
+		status[imageStatusName(index, "lastUpdate")] = lastUpdate
+		status[imageStatusName(index, "lastError")] = health.LastError
+		status[imageStatusName(index, "decodeFailures")] = strconv.Itoa(health.DecodeFailures)
+		status[imageStatusName(index, "frameRate")] = strconv.FormatFloat(health.FrameRate, 'f', 2, 64)
+	}
+	app.pub.UpdateNodeStatus(config.ID, status)
+}
+
+// clearSourceStatus clears the node status of the image placements from firstIndex up to endIndex
+// This is used for images that are removed, as the publisher has no means to remove node status.
+func (app *WallpaperApp) clearSourceStatus(wallpaperID string, firstIndex int, endIndex int) {
+	status := types.NodeStatusMap{}
+	for index := firstIndex; index < endIndex; index++ {
+		for _, statusName := range imageStatusNames {
+			status[imageStatusName(index, statusName)] = ""
+		}
+	}
+	app.pub.UpdateNodeStatus(wallpaperID, status)
+}
+
+// publishHealthChanges publishes an event for each source that became healthy or stale
+func (app *WallpaperApp) publishHealthChanges(montage *Montage) {
+	wallpaperID := montage.getConfig().ID
+	for _, change := range montage.TakeHealthChanges() {
+		if change.Healthy {
+			logrus.Infof("publishHealthChanges: Source %s of wallpaper %s is healthy", change.Source, wallpaperID)
+		} else {
+			logrus.Warningf("publishHealthChanges: Source %s of wallpaper %s is stale", change.Source, wallpaperID)
+		}
+		event, _ := json.Marshal(change)
+		app.pub.UpdateOutputValue(wallpaperID, OutputTypeSourceHealth, types.DefaultOutputInstance, string(event))
+	}
+}
@@ -0,0 +1,116 @@
+// Package internal with wallpaper configuration reloading
+package internal
+
+import (
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// ConfigReloadDelay is the time to wait for more changes to the configuration file before reloading it
+const ConfigReloadDelay = 500 * time.Millisecond
+
+// ApplyAppConfig applies a new application configuration to the running wallpapers
+// New wallpapers are created, removed wallpapers are deleted and changed wallpapers are rebuilt.
+func (app *WallpaperApp) ApplyAppConfig(config *AppConfig) {
+	logrus.Infof("ApplyAppConfig: Applying configuration with %d wallpapers", len(config.Wallpapers))
+	if config.UseLibJPEG != app.config.UseLibJPEG {
+		logrus.Warningf("ApplyAppConfig: Change of useLibJPEG requires a restart")
+	}
+	newIDs := make(map[string]bool)
+	for _, wallpaper := range config.Wallpapers {
+		newIDs[wallpaper.ID] = true
+		montage := app.GetWallpaper(wallpaper.ID)
+		if montage == nil {
+			app.CreateWallpaper(wallpaper)
+		} else if !reflect.DeepEqual(montage.getConfig(), *wallpaper) {
+			app.UpdateWallpaper(wallpaper)
+		}
+	}
+	app.montagesMutex.RLock()
+	removedIDs := make([]string, 0)
+	for ID := range app.montages {
+		if !newIDs[ID] {
+			removedIDs = append(removedIDs, ID)
+		}
+	}
+	app.montagesMutex.RUnlock()
+	for _, ID := range removedIDs {
+		app.DeleteWallpaper(ID)
+	}
+	app.configMutex.Lock()
+	app.config.Wallpapers = config.Wallpapers
+	app.configMutex.Unlock()
+}
+
+// ReloadConfigFile loads the application configuration file and applies it
+// The current configuration remains in use if the file is invalid.
+func (app *WallpaperApp) ReloadConfigFile(filename string) error {
+	config := &AppConfig{}
+	err := LoadAppConfig(filename, config)
+	if err != nil {
+		logrus.Errorf("ReloadConfigFile: Keeping current configuration: %s", err)
+		return err
+	}
+	app.ApplyAppConfig(config)
+	return nil
+}
+
+// WatchConfigFile reloads the application configuration when the configuration file changes
+// The folder of the file is watched so that files replaced by editors are also detected.
+func (app *WallpaperApp) WatchConfigFile(filename string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logrus.Errorf("WatchConfigFile: Unable to create watcher: %s", err)
+		return err
+	}
+	filename = filepath.Clean(filename)
+	err = watcher.Add(filepath.Dir(filename))
+	if err != nil {
+		logrus.Errorf("WatchConfigFile: Unable to watch %s: %s", filename, err)
+		watcher.Close()
+		return err
+	}
+	app.configWatcher = watcher
+	logrus.Infof("WatchConfigFile: Watching %s for changes", filename)
+
+	go func() {
+		var reloadTimer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != filename ||
+					event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				// wait for the file to be completely written before reloading
+				if reloadTimer != nil {
+					reloadTimer.Stop()
+				}
+				reloadTimer = time.AfterFunc(ConfigReloadDelay, func() {
+					_ = app.ReloadConfigFile(filename)
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logrus.Errorf("WatchConfigFile: Error watching %s: %s", filename, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// StopWatchingConfigFile stops watching the configuration file
+func (app *WallpaperApp) StopWatchingConfigFile() {
+	if app.configWatcher != nil {
+		app.configWatcher.Close()
+		app.configWatcher = nil
+	}
+}
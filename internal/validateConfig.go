@@ -0,0 +1,218 @@
+// Package internal with wallpaper configuration validation
+package internal
+
+import (
+	"fmt"
+	"image"
+	"strings"
+
+	"github.com/iotdomain/iotdomain-go/types"
+)
+
+// Limits of the montage configuration
+const (
+	MinMontageSize   = 16
+	MaxMontageWidth  = 4096
+	MaxMontageHeight = 2160
+	MaxMontageBorder = 100
+	MaxMontageRows   = 5
+)
+
+// Supported image source schemes. Sources without a scheme are output addresses.
+const (
+	SourceSchemeFile  = "file://"
+	SourceSchemeHTTP  = "http://"
+	SourceSchemeHTTPS = "https://"
+)
+
+// validResizes holds the supported resize methods
+var validResizes = map[MontageResize]bool{
+	"": true, MontageResizeCrop: true, MontageResizeFit: true, MontageResizeHeight: true,
+	MontageResizeNone: true, MontageResizeScale: true, MontageResizeWidth: true,
+}
+
+// validAligns holds the supported image alignments
+var validAligns = map[MontageAlign]bool{
+	"": true, MontageAlignBottom: true, MontageAlignBottomLeft: true, MontageAlignBottomRight: true,
+	MontageAlignCenter: true, MontageAlignLeft: true, MontageAlignRight: true,
+	MontageAlignTop: true, MontageAlignTopLeft: true, MontageAlignTopRight: true,
+}
+
+// validLayouts holds the supported layouts
+var validLayouts = map[MontageLayout]bool{
+	"": true, MontageLayoutFree: true, MontageLayoutGrid: true, MontageLayoutJustified: true,
+	MontageLayout1Plus5: true, MontageLayout1Plus7: true, MontageLayout2Plus8: true, MontageLayoutSideStrip: true,
+}
+
+// Validate checks the montage configuration and returns an error describing all problems found
+// Returns nil if the configuration is valid.
+func (config *MontageConfig) Validate() error {
+	problems := make([]string, 0)
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if config.ID == "" {
+		addProblem("missing ID")
+	} else if config.ID == ManagerNodeID {
+		addProblem("ID '%s' is reserved", config.ID)
+	}
+	// the layout can only be checked on a canvas and grid of valid size
+	isLayoutUsable := true
+	if config.Width < MinMontageSize || config.Width > MaxMontageWidth {
+		addProblem("width %d is not in range %d-%d", config.Width, MinMontageSize, MaxMontageWidth)
+		isLayoutUsable = false
+	}
+	if config.Height < MinMontageSize || config.Height > MaxMontageHeight {
+		addProblem("height %d is not in range %d-%d", config.Height, MinMontageSize, MaxMontageHeight)
+		isLayoutUsable = false
+	}
+	if config.Border < 0 || config.Border > MaxMontageBorder {
+		addProblem("border %d is not in range 0-%d", config.Border, MaxMontageBorder)
+		isLayoutUsable = false
+	}
+	if (config.Layout == MontageLayoutGrid || config.Layout == "") &&
+		(config.Rows < 1 || config.Rows > MaxMontageRows) {
+		addProblem("rows %d is not in range 1-%d", config.Rows, MaxMontageRows)
+		isLayoutUsable = false
+	}
+	if !validLayouts[config.Layout] {
+		addProblem("unknown layout '%s'", config.Layout)
+		isLayoutUsable = false
+	}
+	if !validResizes[config.Resize] {
+		addProblem("unknown resize '%s'", config.Resize)
+	}
+	if !validAligns[config.Align] {
+		addProblem("unknown align '%s'", config.Align)
+	}
+	if _, err := parseColor(config.Background); err != nil {
+		addProblem("%s", err)
+	}
+	if config.WaitTime < 0 || config.MaxWaitTime < 0 || config.MaxAge < 0 {
+		addProblem("waitTime, maxWaitTime and maxAge can not be negative")
+	}
+	if _, found := montageFormatInfo[config.Format]; !found {
+		addProblem("unknown format '%s'", config.Format)
+	}
+	if config.Quality < 0 || config.Quality > 100 {
+		addProblem("quality %d is not in range 1-100", config.Quality)
+	}
+	if _, err := parseFileMode(config.FileMode); err != nil {
+		addProblem("%s", err)
+	}
+	if config.HistoryCount < 0 || config.HistoryMaxAge < 0 {
+		addProblem("historyCount and historyMaxAge can not be negative")
+	}
+	renditionNames := make(map[string]bool)
+	for index, rendition := range config.Renditions {
+		for _, problem := range validateRendition(&rendition) {
+			addProblem("rendition %d: %s", index, problem)
+		}
+		if renditionNames[rendition.Name] {
+			addProblem("rendition %d: duplicate name '%s'", index, rendition.Name)
+		}
+		renditionNames[rendition.Name] = true
+	}
+	primaryCount := 0
+	for index, imageConfig := range config.ProposedPlacements {
+		for _, problem := range validatePlacement(&imageConfig) {
+			addProblem("image %d: %s", index, problem)
+		}
+		if imageConfig.Primary {
+			primaryCount++
+		}
+	}
+	if primaryCount > 1 {
+		addProblem("%d images are marked as primary, only one is allowed", primaryCount)
+	}
+	if isLayoutUsable {
+		problems = append(problems, validateLayout(config)...)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration of wallpaper '%s': %s", config.ID, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validateRendition checks the configuration of a rendition and returns the problems found
+func validateRendition(rendition *MontageRendition) []string {
+	problems := make([]string, 0)
+	if rendition.Name == "" || rendition.Name == types.DefaultOutputInstance || strings.Contains(rendition.Name, "/") {
+		problems = append(problems, fmt.Sprintf("invalid name '%s'", rendition.Name))
+	}
+	if (rendition.Width == 0 && rendition.Height == 0) ||
+		rendition.Width < 0 || rendition.Width > MaxMontageWidth ||
+		rendition.Height < 0 || rendition.Height > MaxMontageHeight {
+		problems = append(problems, fmt.Sprintf("size %dx%d is not in range 0-%dx0-%d",
+			rendition.Width, rendition.Height, MaxMontageWidth, MaxMontageHeight))
+	}
+	if _, found := montageFormatInfo[rendition.Format]; !found {
+		problems = append(problems, fmt.Sprintf("unknown format '%s'", rendition.Format))
+	}
+	if rendition.Quality < 0 || rendition.Quality > 100 {
+		problems = append(problems, fmt.Sprintf("quality %d is not in range 1-100", rendition.Quality))
+	}
+	return problems
+}
+
+// validatePlacement checks the configuration of an image placement and returns the problems found
+func validatePlacement(imageConfig *ImagePlacement) []string {
+	problems := make([]string, 0)
+	source := imageConfig.Source
+	if source == "" {
+		problems = append(problems, "missing source")
+	} else if strings.Contains(source, "://") && !strings.HasPrefix(source, SourceSchemeFile) &&
+		!strings.HasPrefix(source, SourceSchemeHTTP) && !strings.HasPrefix(source, SourceSchemeHTTPS) {
+		problems = append(problems, fmt.Sprintf("source '%s' has an unsupported scheme", source))
+	}
+	if !validResizes[imageConfig.Resize] {
+		problems = append(problems, fmt.Sprintf("unknown resize '%s'", imageConfig.Resize))
+	}
+	if !validAligns[imageConfig.Align] {
+		problems = append(problems, fmt.Sprintf("unknown align '%s'", imageConfig.Align))
+	}
+	if imageConfig.Unit != "" && imageConfig.Unit != PlacementUnitPixel && imageConfig.Unit != PlacementUnitPercent {
+		problems = append(problems, fmt.Sprintf("unknown unit '%s'", imageConfig.Unit))
+	}
+	if imageConfig.Width < 0 || imageConfig.Height < 0 || imageConfig.Interval < 0 ||
+		imageConfig.RowSpan < 0 || imageConfig.ColSpan < 0 {
+		problems = append(problems, "width, height, interval and spans can not be negative")
+	}
+	return problems
+}
+
+// validateLayout checks that the actual placement of images is within the canvas and, except for
+// the free layout, that images do not overlap. Returns the problems found.
+func validateLayout(config *MontageConfig) []string {
+	problems := make([]string, 0)
+	if config.Layout == MontageLayoutFree {
+		if _, err := MakeFreeLayout(config); err != nil {
+			problems = append(problems, err.Error())
+		}
+		return problems
+	}
+	canvasRect := image.Rect(0, 0, config.Width, config.Height)
+	placements := MakeLayout(config, nil)
+	if len(placements) < len(config.ProposedPlacements) && config.Layout != MontageLayoutSideStrip {
+		problems = append(problems, fmt.Sprintf("only %d of %d images fit in the layout",
+			len(placements), len(config.ProposedPlacements)))
+	}
+	rects := make([]image.Rectangle, len(placements))
+	for index, placement := range placements {
+		rects[index] = image.Rect(placement.X, placement.Y, placement.X+placement.Width, placement.Y+placement.Height)
+		if placement.Width <= 0 || placement.Height <= 0 {
+			problems = append(problems, fmt.Sprintf("image '%s' has no space on the canvas", placement.Source))
+		} else if !rects[index].In(canvasRect) {
+			problems = append(problems, fmt.Sprintf("image '%s' at %v is outside the %dx%d canvas",
+				placement.Source, rects[index], config.Width, config.Height))
+		}
+		for other := 0; other < index; other++ {
+			if rects[index].Overlaps(rects[other]) {
+				problems = append(problems, fmt.Sprintf("image '%s' overlaps image '%s'",
+					placement.Source, placements[other].Source))
+			}
+		}
+	}
+	return problems
+}
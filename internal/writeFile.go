@@ -0,0 +1,176 @@
+// Package internal with atomic writing of wallpaper image files and their history
+package internal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultFileMode is the permission of image files if no file mode is configured
+const DefaultFileMode os.FileMode = 0644
+
+// historyTimeFormat is the format of the timestamp in the name of history images
+const historyTimeFormat = "20060102-150405.000"
+
+// parseFileMode parses an octal file mode like '0644'. An empty mode is the default file mode.
+func parseFileMode(fileMode string) (os.FileMode, error) {
+	if fileMode == "" {
+		return DefaultFileMode, nil
+	}
+	mode, err := strconv.ParseUint(fileMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid file mode '%s', expected octal permissions like 0644", fileMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to the filename
+// Readers of the file never see a partially written file.
+func writeFileAtomic(filename string, data []byte, mode os.FileMode) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpFilename := tmpFile.Name()
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Chmod(mode)
+	}
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFilename, filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFilename)
+	}
+	return err
+}
+
+// updateSymlink points the symbolic link to the target, replacing an existing link atomically
+func updateSymlink(target string, link string) error {
+	absTarget, err := filepath.Abs(target)
+	if err != nil {
+		return err
+	}
+	tmpLink := link + ".tmp"
+	_ = os.Remove(tmpLink)
+	err = os.Symlink(absTarget, tmpLink)
+	if err == nil {
+		err = os.Rename(tmpLink, link)
+	}
+	return err
+}
+
+// historyImageName returns the name of the history image of a wallpaper created at the given time
+func historyImageName(config *MontageConfig, created time.Time) string {
+	return config.ID + "-" + created.Format(historyTimeFormat) + config.Format.FileExt()
+}
+
+// pruneHistory removes the history images of a wallpaper that exceed the configured count or age
+func pruneHistory(config *MontageConfig, now time.Time) error {
+	if config.HistoryCount <= 0 && config.HistoryMaxAge <= 0 {
+		return nil
+	}
+	files, err := ioutil.ReadDir(config.HistoryFolder)
+	if err != nil {
+		return err
+	}
+	// history images are named with a timestamp, so sorting by name sorts by age
+	names := make([]string, 0, len(files))
+	created := make(map[string]time.Time)
+	for _, file := range files {
+		timestamp := strings.TrimPrefix(file.Name(), config.ID+"-")
+		timestamp = strings.TrimSuffix(timestamp, config.Format.FileExt())
+		createTime, err := time.ParseInLocation(historyTimeFormat, timestamp, time.Local)
+		if file.IsDir() || err != nil || historyImageName(config, createTime) != file.Name() {
+			continue
+		}
+		names = append(names, file.Name())
+		created[file.Name()] = createTime
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	maxAge := time.Duration(config.HistoryMaxAge) * time.Second
+	for index, name := range names {
+		if (config.HistoryCount > 0 && index >= config.HistoryCount) ||
+			(maxAge > 0 && now.Sub(created[name]) > maxAge) {
+			err = os.Remove(filepath.Join(config.HistoryFolder, name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeImageFiles writes the wallpaper image to the configured file and history folder and
+// points the latest link to the newest file.
+func writeImageFiles(config *MontageConfig, data []byte, now time.Time) error {
+	mode, err := parseFileMode(config.FileMode)
+	if err != nil {
+		return err
+	}
+	latestFile := ""
+	if config.Filename != "" {
+		latestFile = config.ImageFilename(config.Filename)
+		err = writeFileAtomic(latestFile, data, mode)
+		if err != nil {
+			return err
+		}
+	}
+	if config.HistoryFolder != "" {
+		err = os.MkdirAll(config.HistoryFolder, 0755)
+		if err == nil {
+			latestFile = filepath.Join(config.HistoryFolder, historyImageName(config, now))
+			err = writeFileAtomic(latestFile, data, mode)
+		}
+		if err == nil {
+			err = pruneHistory(config, now)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if config.LatestLink != "" && latestFile != "" {
+		err = updateSymlink(latestFile, config.LatestLink)
+	}
+	return err
+}
+
+// saveRenditionImage saves the image of a rendition to its file, if configured
+func (app *WallpaperApp) saveRenditionImage(config *MontageConfig, rendition *MontageRendition, data []byte) error {
+	if rendition.Filename == "" {
+		return nil
+	}
+	mode, err := parseFileMode(config.FileMode)
+	if err == nil {
+		err = writeFileAtomic(renditionConfig(config, rendition).ImageFilename(rendition.Filename), data, mode)
+	}
+	if err != nil {
+		logrus.Errorf("saveRenditionImage: Unable to save rendition %s of wallpaper %s: %s", rendition.Name, config.ID, err)
+	}
+	return err
+}
+
+// saveWallpaperImage saves the wallpaper image files of the montage, if configured
+func (app *WallpaperApp) saveWallpaperImage(config *MontageConfig, data []byte) error {
+	if config.Filename == "" && config.HistoryFolder == "" {
+		return nil
+	}
+	err := writeImageFiles(config, data, time.Now())
+	if err != nil {
+		logrus.Errorf("saveWallpaperImage: Unable to save the image of wallpaper %s: %s", config.ID, err)
+	}
+	return err
+}